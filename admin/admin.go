@@ -0,0 +1,141 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/audit"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/session"
+	"github.com/Scrimzay/loglogger"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	log *logger.Logger
+)
+
+func init() {
+	var err error
+	log, err = logger.New("adminlog.txt")
+	if err != nil {
+		log.Fatalf("Error starting new log in admin: %v", err)
+	}
+}
+
+// what an account is allowed to do. Every account starts as a player
+const (
+	RolePlayer  = "player"
+	RoleSupport = "support" // can look at everything under /admin but change nothing
+	RoleAdmin   = "admin"   // can also adjust balances and change roles
+)
+
+// roleContextKey is where Require leaves the staff member's role
+const roleContextKey = "role"
+
+// ValidRole reports whether role is one the users table accepts
+func ValidRole(role string) bool {
+	switch role {
+	case RolePlayer, RoleSupport, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// Require is middleware that only lets through signed in accounts with one
+// of the given roles. The role is read from the users table on every request
+// rather than kept in the session, so a demotion takes effect straight away.
+// It has to run after session.Load
+func Require(users repo.UserRepo, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := session.CurrentUser(c)
+		if !ok {
+			c.Redirect(http.StatusFound, "/login")
+			c.Abort()
+			return
+		}
+
+		account, err := users.FindByObfID(c.Request.Context(), user.ObfID)
+		if err != nil && !errors.Is(err, repo.ErrNotFound) {
+			log.Printf("Error looking up role: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		for _, role := range roles {
+			if account.Role == role {
+				c.Set(roleContextKey, account.Role)
+				c.Next()
+				return
+			}
+		}
+
+		log.Printf("Refused %s %s to obfID=%s with role %q", c.Request.Method, c.Request.URL.Path, user.ObfID, account.Role)
+		c.AbortWithStatus(http.StatusForbidden)
+	}
+}
+
+// isAdmin is for templates, to only show admins the forms they can use
+func isAdmin(c *gin.Context) bool {
+	return c.GetString(roleContextKey) == RoleAdmin
+}
+
+// Auditor records what staff do, in the staff audit log the admin pages
+// show and in the tamper evident audit trail
+type Auditor struct {
+	entries repo.AuditRepo
+	trail   *audit.Trail
+}
+
+func NewAuditor(entries repo.AuditRepo, trail *audit.Trail) *Auditor {
+	return &Auditor{entries: entries, trail: trail}
+}
+
+// record is called once the change has already happened, so a failure is
+// logged rather than undoing it
+func (a *Auditor) record(ctx context.Context, actor, action, target, detail string) {
+	err := a.entries.Append(ctx, repo.AuditEntry{
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	})
+	if err != nil {
+		log.Printf("Error writing audit entry: actor=%s, action=%s, target=%s, detail=%s: %v", actor, action, target, detail, err)
+	}
+	log.Printf("Audit: actor=%s, action=%s, target=%s, detail=%s", actor, action, target, detail)
+
+	a.trail.RecordOrLog(ctx, audit.TypeAdmin, actor, target, audit.Data{
+		"action": action,
+		"detail": detail,
+	})
+}
+
+// AuditHandler shows the newest entries in the staff audit log
+func AuditHandler(auditor *Auditor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		list, err := auditor.entries.List(c.Request.Context(), 200)
+		if err != nil {
+			log.Printf("Error listing audit log: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		rows := make([]gin.H, 0, len(list))
+		for _, e := range list {
+			rows = append(rows, gin.H{
+				"When":   e.CreatedAt.Format(time.DateTime),
+				"Actor":  e.Actor,
+				"Action": e.Action,
+				"Target": e.Target,
+				"Detail": e.Detail,
+			})
+		}
+
+		c.HTML(200, "admin_audit.html", gin.H{
+			"Entries": rows,
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/session"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrNoTable  = errors.New("no such table")
+	ErrNoBet    = errors.New("there's no bet in play at this table")
+	ErrNotDealt = errors.New("the cards haven't been dealt yet, void the round instead")
+)
+
+// TableSummary is what staff see of one live table
+type TableSummary struct {
+	ID          string
+	Seat        string // obfuscated id of whoever placed the bet, if anyone has
+	State       string
+	Bet         string
+	BetInPlay   bool
+	Player      int // player's score
+	Dealer      int // dealer's score
+	Penetration int // percent of the shoe dealt
+	Paused      bool
+	Closing     bool
+	Created     time.Time
+	LastActive  time.Time
+}
+
+// Tables is the live tables. They live in main, so they're reached through
+// this rather than imported. Every action returns what it did, for the audit
+// log, and the player whose bet it touched if there was one
+type Tables interface {
+	Summaries() []TableSummary
+	// Pause stops or restarts play at the table
+	Pause(gameID string, paused bool) (player string, err error)
+	// Settle plays the hand in progress out as if the player stood and pays it
+	Settle(ctx context.Context, gameID string) (player, detail string, err error)
+	// Void calls the round off and refunds the bet
+	Void(ctx context.Context, gameID string) (player, detail string, err error)
+	// Close shuts the table now if nothing is riding on it, otherwise once
+	// the hand in play is over
+	Close(ctx context.Context, gameID string) (player, detail string, err error)
+}
+
+// tableMessages are the outcomes the table actions redirect back with
+var tableMessages = map[string]string{
+	"paused":  "Table paused.",
+	"resumed": "Table resumed.",
+	"settled": "Hand settled.",
+	"voided":  "Round voided and the bet refunded.",
+	"closed":  "Table closed, or closing once the hand in play is over.",
+}
+
+// TablesHandler lists every live table, most recently played first
+func TablesHandler(tables Tables) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		summaries := tables.Summaries()
+		sort.Slice(summaries, func(i, j int) bool {
+			return summaries[i].LastActive.After(summaries[j].LastActive)
+		})
+
+		rows := make([]gin.H, 0, len(summaries))
+		for _, t := range summaries {
+			status := "open"
+			switch {
+			case t.Paused:
+				status = "paused"
+			case t.Closing:
+				status = "closing"
+			}
+			rows = append(rows, gin.H{
+				"ID":          t.ID,
+				"Seat":        t.Seat,
+				"State":       t.State,
+				"Bet":         t.Bet,
+				"BetInPlay":   t.BetInPlay,
+				"Player":      t.Player,
+				"Dealer":      t.Dealer,
+				"Penetration": t.Penetration,
+				"Status":      status,
+				"Paused":      t.Paused,
+				"Age":         time.Since(t.Created).Round(time.Second).String(),
+				"Idle":        time.Since(t.LastActive).Round(time.Second).String(),
+			})
+		}
+
+		c.HTML(http.StatusOK, "admin_tables.html", gin.H{
+			"Tables":    rows,
+			"IsAdmin":   isAdmin(c),
+			"Message":   tableMessages[c.Query("message")],
+			"CSRFToken": session.CSRFToken(c),
+		})
+	}
+}
+
+// TableActionHandler runs one of the table actions, pause, resume, settle,
+// void or close, and audits it
+func TableActionHandler(tables Tables, auditor *Auditor, action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		staff, _ := session.CurrentUser(c)
+		gameID := c.Param("id")
+
+		var player, detail, message string
+		var err error
+		switch action {
+		case "pause", "resume":
+			player, err = tables.Pause(gameID, action == "pause")
+			message = action + "d"
+		case "settle":
+			player, detail, err = tables.Settle(ctx, gameID)
+			message = "settled"
+		case "void":
+			player, detail, err = tables.Void(ctx, gameID)
+			message = "voided"
+		case "close":
+			player, detail, err = tables.Close(ctx, gameID)
+			message = "closed"
+		default:
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		switch {
+		case errors.Is(err, ErrNoTable):
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		case errors.Is(err, ErrNoBet), errors.Is(err, ErrNotDealt):
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			log.Printf("Error running table action %s on %s: %v", action, gameID, err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if detail == "" {
+			detail = fmt.Sprintf("table=%s", gameID)
+		} else {
+			detail = fmt.Sprintf("table=%s, %s", gameID, detail)
+		}
+		auditor.record(ctx, staff.ObfID, "table_"+action, player, detail)
+		c.Redirect(http.StatusFound, "/admin/tables?message="+message)
+	}
+}
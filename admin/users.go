@@ -0,0 +1,230 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/session"
+	"github.com/gin-gonic/gin"
+)
+
+// adminMessages are the outcomes the user page redirects report
+var adminMessages = map[string]string{
+	"adjusted":     "Balance adjusted.",
+	"role-changed": "Role changed.",
+}
+
+// UsersHandler lists accounts, newest first, optionally searching by
+// obfuscated id or email
+func UsersHandler(users repo.UserRepo) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		search := strings.TrimSpace(c.Query("q"))
+
+		list, err := users.List(c.Request.Context(), search, 100)
+		if err != nil {
+			log.Printf("Error listing users: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		rows := make([]gin.H, 0, len(list))
+		for _, u := range list {
+			rows = append(rows, gin.H{
+				"ObfID":    u.ObfID,
+				"Email":    u.Email,
+				"Provider": u.Provider,
+				"Role":     u.Role,
+				"Closed":   u.Closed(),
+				"Joined":   u.CreatedAt.Format("2006-01-02"),
+			})
+		}
+
+		c.HTML(200, "admin_users.html", gin.H{
+			"Search": search,
+			"Users":  rows,
+		})
+	}
+}
+
+// UserHandler shows one account with its balances, logins and every ledger
+// entry, newest first
+func UserHandler(repos *repo.Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		obfID := c.Param("obfID")
+
+		account, err := repos.Users.FindByObfID(ctx, obfID)
+		if errors.Is(err, repo.ErrNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error finding user: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		balances, err := repos.Balances.Balances(ctx, obfID)
+		if err != nil {
+			log.Printf("Error fetching balances: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		var balanceRows []gin.H
+		for _, cur := range currency.All() {
+			balanceRows = append(balanceRows, gin.H{
+				"Code":    cur.Code,
+				"Name":    cur.Name,
+				"Balance": cur.Display(balances[cur.Code]),
+			})
+		}
+
+		journal, err := repos.Balances.Journal(ctx, obfID)
+		if err != nil {
+			log.Printf("Error fetching journal: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		journalRows := make([]gin.H, 0, len(journal))
+		for i := len(journal) - 1; i >= 0; i-- {
+			e := journal[i]
+			journalRows = append(journalRows, gin.H{
+				"When":      e.CreatedAt.Format(time.DateTime),
+				"TxID":      e.TxID,
+				"Kind":      e.Kind,
+				"Amount":    currency.Format(e.Currency, e.Amount),
+				"Currency":  e.Currency,
+				"Reference": e.Reference,
+			})
+		}
+
+		identities, err := repos.Users.ListIdentities(ctx, obfID)
+		if err != nil {
+			log.Printf("Error listing identities: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.HTML(200, "admin_user.html", gin.H{
+			"User":       account,
+			"Closed":     account.Closed(),
+			"Balances":   balanceRows,
+			"Journal":    journalRows,
+			"Identities": identities,
+			"Currencies": currency.All(),
+			"Roles":      []string{RolePlayer, RoleSupport, RoleAdmin},
+			"IsAdmin":    isAdmin(c),
+			"Message":    adminMessages[c.Query("message")],
+			"CSRFToken":  session.CSRFToken(c),
+		})
+	}
+}
+
+// AdjustHandler credits or debits a player's balance by hand, for fixing
+// mistakes and goodwill payments. It goes through the ledger like any other
+// money movement, and the reason is required so the audit log says why
+func AdjustHandler(users repo.UserRepo, books *ledger.Ledger, auditor *Auditor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		staff, _ := session.CurrentUser(c)
+		obfID := c.Param("obfID")
+
+		if _, err := users.FindByObfID(ctx, obfID); err != nil {
+			if errors.Is(err, repo.ErrNotFound) {
+				c.AbortWithStatus(http.StatusNotFound)
+				return
+			}
+			log.Printf("Error finding user: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		cur, ok := currency.Lookup(c.PostForm("currency"))
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Unknown currency"})
+			return
+		}
+		amount, err := cur.Parse(c.PostForm("amount"))
+		if err != nil || amount <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+			return
+		}
+		reason := strings.TrimSpace(c.PostForm("reason"))
+		if reason == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "A reason is required"})
+			return
+		}
+
+		var kind ledger.Kind
+		switch c.PostForm("direction") {
+		case "credit":
+			kind = ledger.KindAdjustCredit
+		case "debit":
+			kind = ledger.KindAdjustDebit
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Direction must be credit or debit"})
+			return
+		}
+
+		txID, err := books.Record(ctx, kind, obfID, cur.Code, amount, "admin:"+staff.ObfID)
+		if errors.Is(err, ledger.ErrInsufficientFunds) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "The balance can't cover that debit"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error recording adjustment: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		auditor.record(ctx, staff.ObfID, string(kind), obfID,
+			fmt.Sprintf("%s, txID=%s, reason: %s", cur.Display(amount), txID, reason))
+		c.Redirect(http.StatusFound, "/admin/users/"+obfID+"?message=adjusted")
+	}
+}
+
+// RoleHandler promotes or demotes an account
+func RoleHandler(users repo.UserRepo, auditor *Auditor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		staff, _ := session.CurrentUser(c)
+		obfID := c.Param("obfID")
+
+		role := c.PostForm("role")
+		if !ValidRole(role) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+			return
+		}
+		// someone has to be left able to get back in
+		if obfID == staff.ObfID && role != RoleAdmin {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "You can't demote yourself"})
+			return
+		}
+
+		account, err := users.FindByObfID(ctx, obfID)
+		if errors.Is(err, repo.ErrNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error finding user: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if err := users.SetRole(ctx, obfID, role); err != nil {
+			log.Printf("Error setting role: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		auditor.record(ctx, staff.ObfID, "set_role", obfID, account.Role+" -> "+role)
+		c.Redirect(http.StatusFound, "/admin/users/"+obfID+"?message=role-changed")
+	}
+}
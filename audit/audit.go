@@ -0,0 +1,157 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/loglogger"
+)
+
+var (
+	log *logger.Logger
+)
+
+func init() {
+	var err error
+	log, err = logger.New("auditlog.txt")
+	if err != nil {
+		log.Fatalf("Failed to start new logger in audit: %v", err)
+	}
+}
+
+// event types in the audit log
+const (
+	TypeLogin         = "login"
+	TypeLogout        = "logout"
+	TypeLogoutAll     = "logout_all"
+	TypeSessionRevoke = "session_revoke"
+	TypeLedger        = "ledger" // any money movement, deposits, bets, payouts, refunds, adjustments
+	TypeAccountCreate = "account_create"
+	TypeAccountLink   = "account_link"
+	TypeAccountUnlink = "account_unlink"
+	TypeAccountClose  = "account_close"
+	TypeAdmin         = "admin" // anything staff did through /admin or the CLI
+)
+
+// actors that aren't a player
+const (
+	ActorSystem = "system" // the server itself, like the reaper or daily top ups
+	ActorCLI    = "cli"
+)
+
+// Data is the detail of an event, stored as JSON
+type Data map[string]any
+
+// Trail writes events to the audit log
+type Trail struct {
+	events repo.EventRepo
+}
+
+func New(events repo.EventRepo) *Trail {
+	return &Trail{events: events}
+}
+
+// Record appends an event to the audit log. The thing being recorded has
+// usually already happened, so callers log a failure rather than undo it
+func (t *Trail) Record(ctx context.Context, typ, actor, subject string, data Data) error {
+	_, err := t.events.Append(ctx, Seal(typ, actor, subject, data))
+	if err != nil {
+		return fmt.Errorf("error recording %s audit event: %w", typ, err)
+	}
+	return nil
+}
+
+// Seal builds the event that follows last in the chain, for Record to
+// append on its own
+func Seal(typ, actor, subject string, data Data) func(last repo.Event) (repo.Event, error) {
+	return func(last repo.Event) (repo.Event, error) {
+		e, err := NewEvent(typ, actor, subject, data)
+		if err != nil {
+			return e, err
+		}
+		return Link(e, last), nil
+	}
+}
+
+// NewEvent builds an event without its place in the chain. The ledger hands
+// it to the balance repository, which queues it in the same transaction as
+// the posting for Chain to link in afterwards
+func NewEvent(typ, actor, subject string, data Data) (repo.Event, error) {
+	if data == nil {
+		data = Data{}
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return repo.Event{}, fmt.Errorf("error encoding audit data: %w", err)
+	}
+
+	return repo.Event{
+		Type:    typ,
+		Actor:   actor,
+		Subject: subject,
+		Data:    string(body),
+		// Postgres keeps microseconds, the hash has to survive the round trip
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}, nil
+}
+
+// Link places e after last in the chain
+func Link(e, last repo.Event) repo.Event {
+	e.Seq = last.Seq + 1
+	e.PrevHash = last.Hash
+	e.Hash = Hash(e)
+	return e
+}
+
+// Chain links the events postings have queued onto the end of the log, it
+// returns how many there were
+func (t *Trail) Chain(ctx context.Context) (int, error) {
+	chained, err := t.events.Chain(ctx, Link)
+	if err != nil {
+		return chained, fmt.Errorf("error chaining audit events: %w", err)
+	}
+	return chained, nil
+}
+
+// StartChainer runs Chain every interval, so the postings' events don't wait
+// in the queue for long
+func (t *Trail) StartChainer(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := t.Chain(context.Background()); err != nil {
+				log.Printf("Error chaining audit events: %v", err)
+			}
+		}
+	}()
+}
+
+// RecordOrLog is Record for callers that can't do anything about a failure
+func (t *Trail) RecordOrLog(ctx context.Context, typ, actor, subject string, data Data) {
+	if err := t.Record(ctx, typ, actor, subject, data); err != nil {
+		log.Printf("MISSING AUDIT EVENT type=%s, actor=%s, subject=%s, data=%v: %v", typ, actor, subject, data, err)
+	}
+}
+
+// Hash is the event's link in the chain, covering everything in the event
+// including the hash of the one before it
+func Hash(e repo.Event) string {
+	// a struct, not a map, so the fields always encode in the same order
+	body, _ := json.Marshal(struct {
+		Seq       int64
+		Type      string
+		Actor     string
+		Subject   string
+		Data      string
+		CreatedAt string
+		PrevHash  string
+	}{e.Seq, e.Type, e.Actor, e.Subject, e.Data, e.CreatedAt.UTC().Format(time.RFC3339Nano), e.PrevHash})
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,65 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Scrimzay/blackjackgame/repo"
+)
+
+// verifyPage is how many events Verify reads at a time
+const verifyPage = 1000
+
+// Problem is one place the chain doesn't hold
+type Problem struct {
+	Seq    int64
+	Reason string
+}
+
+// VerifyReport is what Verify found
+type VerifyReport struct {
+	Events   int64
+	Head     string // hash of the last event, worth writing down somewhere the DB can't reach
+	Problems []Problem
+}
+
+// OK reports whether the whole chain checked out
+func (r VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Verify walks the audit log from the start, checking every event's hash,
+// that it links to the one before and that no sequence numbers are missing.
+// The hashes aren't keyed, so someone who can rewrite the table can rebuild
+// the chain after their edit. Comparing Head against an earlier run catches that
+func Verify(ctx context.Context, events repo.EventRepo) (VerifyReport, error) {
+	var report VerifyReport
+	var prev repo.Event
+	for {
+		page, err := events.Events(ctx, prev.Seq, verifyPage)
+		if err != nil {
+			return report, err
+		}
+		for _, e := range page {
+			report.Events++
+			if e.Seq != prev.Seq+1 {
+				report.Problems = append(report.Problems, Problem{e.Seq,
+					fmt.Sprintf("gap, expected seq %d", prev.Seq+1)})
+			}
+			if e.PrevHash != prev.Hash {
+				report.Problems = append(report.Problems, Problem{e.Seq,
+					"prev_hash doesn't match the hash of the event before it"})
+			}
+			if Hash(e) != e.Hash {
+				report.Problems = append(report.Problems, Problem{e.Seq,
+					"hash doesn't match the event, it has been changed"})
+			}
+			prev = e
+		}
+		if len(page) < verifyPage {
+			break
+		}
+	}
+	report.Head = prev.Hash
+	return report, nil
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Scrimzay/blackjackgame/audit"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/session"
+	"github.com/gin-gonic/gin"
+)
+
+// accountMessages are the outcomes the link and unlink redirects report
+var accountMessages = map[string]string{
+	"linked":         "Login linked, you can now sign in with it too.",
+	"already-linked": "That login already belongs to another account.",
+	"unlinked":       "Login unlinked.",
+	"last-identity":  "You can't unlink your only way to sign in.",
+}
+
+// AccountHandler lists the logins linked to the player's account and offers
+// to link the enabled providers they haven't used yet
+func AccountHandler(users repo.UserRepo) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := session.CurrentUser(c)
+
+		identities, err := users.ListIdentities(c.Request.Context(), user.ObfID)
+		if err != nil {
+			log.Printf("Error listing identities: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		linked := make(map[string]bool)
+		rows := make([]gin.H, 0, len(identities))
+		for _, id := range identities {
+			linked[id.Provider] = true
+			rows = append(rows, gin.H{
+				"Provider":       id.Provider,
+				"Label":          providerLabel(id.Provider),
+				"ProviderUserID": id.ProviderUserID,
+				"Email":          id.Email,
+				"Linked":         id.CreatedAt.Format("2006-01-02"),
+			})
+		}
+
+		var linkable []gin.H
+		for _, p := range loginProviders {
+			if !linked[p["Name"].(string)] {
+				linkable = append(linkable, p)
+			}
+		}
+
+		c.HTML(200, "account.html", gin.H{
+			"ObfID":      user.ObfID,
+			"Identities": rows,
+			"Linkable":   linkable,
+			"Message":    accountMessages[c.Query("message")],
+			"CSRFToken":  session.CSRFToken(c),
+		})
+	}
+}
+
+// UnlinkHandler removes one login from the player's account
+func UnlinkHandler(users repo.UserRepo, trail *audit.Trail) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := session.CurrentUser(c)
+
+		err := users.UnlinkIdentity(c.Request.Context(), user.ObfID, c.PostForm("provider"), c.PostForm("providerUserID"))
+		if errors.Is(err, repo.ErrLastIdentity) {
+			c.Redirect(http.StatusFound, "/account?message=last-identity")
+			return
+		}
+		if errors.Is(err, repo.ErrNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error unlinking identity: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Unlinked %s login from obfID=%s", c.PostForm("provider"), user.ObfID)
+		trail.RecordOrLog(c.Request.Context(), audit.TypeAccountUnlink, user.ObfID, user.ObfID, audit.Data{
+			"provider":       c.PostForm("provider"),
+			"providerUserID": c.PostForm("providerUserID"),
+		})
+		c.Redirect(http.StatusFound, "/account?message=unlinked")
+	}
+}
+
+// providerLabel is the display name of a provider, even one that has since
+// been turned off in the config
+func providerLabel(name string) string {
+	for _, p := range loginProviders {
+		if p["Name"] == name {
+			return p["Label"].(string)
+		}
+	}
+	return name
+}
@@ -1,26 +1,31 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"time"
 	"encoding/hex"
-	"crypto/sha256"
+	"crypto/rand"
 
-	"github.com/Scrimzay/blackjackgame/db"
+	"github.com/Scrimzay/blackjackgame/audit"
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/session"
 	"github.com/Scrimzay/loglogger"
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/sessions"
-	"github.com/joho/godotenv"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
+	"github.com/markbates/goth/providers/discord"
+	"github.com/markbates/goth/providers/github"
+	"github.com/markbates/goth/providers/google"
+	"github.com/markbates/goth/providers/openidConnect"
 	"github.com/markbates/goth/providers/spotify"
 )
 
 var (
 	log *logger.Logger
-	store *sessions.CookieStore
+	loginProviders []gin.H // enabled providers for the login page, set by ConnectToProvider
 )
 
 func init() {
@@ -31,49 +36,77 @@ func init() {
 	}
 }
 
-func ConnectToProvider() {
-	err := godotenv.Load(".env")
-	if err != nil {
-		log.Fatalf("Error loading .env file in auth: %v", err)
-	}
+// ConnectToProvider registers every login provider in the config, keeping
+// gothic's OAuth state in the shared session store
+func ConnectToProvider(cfg *config.Config, sess *session.Manager) error {
 	fmt.Println("***CONNECT TO PROVIDER RUNNING***")
-	sessionKey := os.Getenv("SESSION_SECRET")
-	if sessionKey == "" {
-		log.Fatal("Session secret not loaded.")
-		return
+
+	gothic.Store = sess.Store()
+
+	var providers []goth.Provider
+	for _, p := range cfg.Providers {
+		callbackURL := cfg.CallbackURL(p.Name)
+		switch p.Name {
+		case "spotify":
+			providers = append(providers, spotify.New(p.Key, p.Secret, callbackURL))
+		case "google":
+			providers = append(providers, google.New(p.Key, p.Secret, callbackURL, "email", "profile"))
+		case "github":
+			providers = append(providers, github.New(p.Key, p.Secret, callbackURL, "user:email"))
+		case "discord":
+			providers = append(providers, discord.New(p.Key, p.Secret, callbackURL, discord.ScopeIdentify, discord.ScopeEmail))
+		case "oidc":
+			// fetches the issuer's discovery document, so this needs the network at startup
+			oidc, err := openidConnect.NewNamed(p.Name, p.Key, p.Secret, callbackURL, p.DiscoveryURL, "email", "profile")
+			if err != nil {
+				return fmt.Errorf("error setting up oidc provider: %w", err)
+			}
+			providers = append(providers, oidc)
+		case "dev":
+			// config already refuses this in production, this is belt and braces
+			if cfg.IsProd() {
+				return fmt.Errorf("the dev provider can't be used in production")
+			}
+			providers = append(providers, newDevProvider(cfg.BaseURL))
+		default:
+			return fmt.Errorf("unknown auth provider: %s", p.Name)
+		}
 	}
+	goth.UseProviders(providers...)
 
-	maxAge := 86400 * 30
-	isProd := false // Change to true for production environment
+	loginProviders = nil
+	for _, p := range cfg.Providers {
+		loginProviders = append(loginProviders, gin.H{"Name": p.Name, "Label": p.Label})
+	}
+	return nil
+}
 
-	store = sessions.NewCookieStore([]byte(sessionKey))
-	store.MaxAge(maxAge)
-	store.Options.Path = ("/")
-	store.Options.HttpOnly = true
-	store.Options.Secure = isProd
-	store.Options.SameSite = http.SameSiteLaxMode
+// LoginHandler shows a sign in button for every enabled provider
+func LoginHandler(c *gin.Context) {
+	renderLogin(c, http.StatusOK, "")
+}
 
-	gothic.Store = store
+func renderLogin(c *gin.Context, status int, message string) {
+	c.HTML(status, "login.html", gin.H{
+		"Message": message,
+		"Providers": loginProviders,
+	})
+}
 
-	goth.UseProviders(
-		spotify.New(os.Getenv("SPOTIFY_ID"), os.Getenv("SPOTIFY_SECRET"), "http://localhost:3000/auth/spotify/callback"),
-	)
+// setProvider tells gothic which provider the request is for, gothic can't
+// see gin's route params
+func setProvider(c *gin.Context, provider string) {
+	q := c.Request.URL.Query()
+	q.Set("provider", provider)
+	c.Request.URL.RawQuery = q.Encode()
 }
 
 func BeginAuthHandler(c *gin.Context) {
 	fmt.Println("****BEGIN AUTH HANDLER RUNNING****")
 
-	// Get the users session
-	session, err := store.Get(c.Request, "session-name")
-	if err != nil {
-		fmt.Println("Error getting session, most likely not signed in")
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-
-	fmt.Println("Got the users session in beginauth")
-	// Check if user is already authenticated
-	if userID, ok := session.Values["user_id"]; ok && userID != "" {
+	// Check if user is already authenticated, unless they're here to link
+	// another login to their account
+	if _, ok := session.CurrentUser(c); ok && c.Query("link") == "" {
 		// If user is already logged in, return to home
 		c.Redirect(http.StatusFound, "/")
 		return
@@ -82,182 +115,160 @@ func BeginAuthHandler(c *gin.Context) {
 	// Extract the provider
 	provider := c.Param("provider")
 	if provider == "" {
-		c.HTML(http.StatusBadRequest, "login.html", gin.H{
-			"Message": "Provider not specified",
-		})
+		renderLogin(c, http.StatusBadRequest, "Provider not specified")
 		return
 	}
 
-	q := c.Request.URL.Query()
-	q.Add("provider", provider)
-	c.Request.URL.RawQuery = q.Encode()
+	setProvider(c, provider)
 
 	fmt.Println("Request URL: ", c.Request.URL.String())
 
 	gothic.BeginAuthHandler(c.Writer, c.Request)
 }
 
-func CompleteAuthHandler(c *gin.Context) {
-	fmt.Println("****COMPLETE AUTH HANDLER RUNNING****")
-
-	provider := c.Param("provider")
-	fmt.Println("Provider: ", provider)
-
-	user, err := gothic.CompleteUserAuth(c. Writer, c.Request)
-	if err != nil {
-		fmt.Println("Could not complete user auth")
-		c.Redirect(http.StatusTemporaryRedirect, "/login")
-		return
-	}
-
-	fmt.Println("Authenticated user: ", user)
-
-	fmt.Println("Connecting to DB")
-	db, err := db.ConnectToDatabase()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	defer db.Close()
-
-	fmt.Println("Connected to DB")
-	email := user.Email
-	userid := user.UserID
-
-	// Get or create session
-	session, err := store.Get(c.Request, "session-name")
-	if err != nil {
-		fmt.Println(err)
-		log.Fatal("Failed to create or retrieve session")
-		return
-	}
-
-	fmt.Println("Created or recieved session")
-
-	// Checks DB for multiple users
-	var userCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE email = $1", email).Scan(&userCount)
-	if err != nil {
-		log.Print(err)
-		return
-	}
-
-	var obfuscatedID string
+func CompleteAuthHandler(users repo.UserRepo, sess *session.Manager, trail *audit.Trail) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fmt.Println("****COMPLETE AUTH HANDLER RUNNING****")
+		ctx := c.Request.Context()
 
-	// If no duplicates, inputs the user in the database, if there is
-	// it just logs theres already a similar user (dupe)
+		provider := c.Param("provider")
+		fmt.Println("Provider: ", provider)
+		setProvider(c, provider)
 
-	fmt.Println("Parsing SQL Query")
-	if userCount == 0 {
-		obfuscatedID = generateObfuscatedID(userid)
-
-		p, err := db.Prepare("INSERT INTO users(oauthid, email, provider, obfuscatedid) VALUES ($1, $2, $3, $4)")
+		user, err := gothic.CompleteUserAuth(c. Writer, c.Request)
 		if err != nil {
-			log.Print(err)
+			fmt.Println("Could not complete user auth")
+			c.Redirect(http.StatusTemporaryRedirect, "/login")
 			return
 		}
-		defer p.Close()
 
-		fmt.Println("Executing SQL Query")
-		_, err = p.Exec(userid, email, provider, obfuscatedID)
-		if err != nil {
-			log.Printf("Error inserting new user: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		fmt.Println("Authenticated user: ", user)
+
+		email := user.Email
+		userid := user.UserID
+
+		// already signed in, so this login is being linked to their account
+		if current, ok := session.CurrentUser(c); ok {
+			err := users.LinkIdentity(ctx, repo.Identity{
+				Provider: provider,
+				ProviderUserID: userid,
+				ObfID: current.ObfID,
+				Email: email,
+			})
+			if errors.Is(err, repo.ErrAlreadyLinked) {
+				c.Redirect(http.StatusFound, "/account?message=already-linked")
+				return
+			}
+			if err != nil {
+				log.Printf("Error linking identity: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			log.Printf("Linked %s login to obfID=%s", provider, current.ObfID)
+			trail.RecordOrLog(ctx, audit.TypeAccountLink, current.ObfID, current.ObfID, audit.Data{
+				"provider":       provider,
+				"providerUserID": userid,
+			})
+			c.Redirect(http.StatusFound, "/account?message=linked")
 			return
 		}
-		fmt.Println("New user added to DB")
-	} else {
-		// Optional: Handle the case where the user already exists (e.g., update or skip)
-		// User already exists in the database, so we skip the insertion and return the ob'd ID
-		err := db.QueryRow("SELECT obfuscatedid FROM users WHERE oauthid = $1", userid).Scan(&obfuscatedID)
-		if err != nil {
-			log.Printf("Error retrieving ob'd ID: %v", err)
+
+		var account repo.User
+
+		// the login finds the account, whichever provider it came from
+		identity, err := users.FindIdentity(ctx, provider, userid)
+		switch {
+		case err == nil:
+			account, err = users.FindByObfID(ctx, identity.ObfID)
+			if err != nil {
+				log.Printf("Error retrieving account for identity: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			fmt.Println("User already in database")
+
+		case errors.Is(err, repo.ErrNotFound):
+			// Checks DB for multiple users, the same email under another
+			// provider means they should sign in with that one and link this
+			// one rather than end up with two accounts
+			userCount, err := users.CountByEmail(ctx, email)
+			if err != nil {
+				log.Print(err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			if email != "" && userCount > 0 {
+				fmt.Println("Email already has an account under another provider")
+				renderLogin(c, http.StatusConflict, "There's already an account with this email. Sign in the way you did before, then link " + provider + " from your account page.")
+				return
+			}
+
+			obfuscatedID, err := generateObfuscatedID()
+			if err != nil {
+				log.Print(err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+				return
+			}
+
+			account = repo.User{
+				OAuthID: userid,
+				Email: email,
+				Provider: provider,
+				ObfID: obfuscatedID,
+			}
+			if err := users.Create(ctx, account); err != nil {
+				log.Printf("Error inserting new user: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			fmt.Println("New user added to DB")
+			trail.RecordOrLog(ctx, audit.TypeAccountCreate, account.ObfID, account.ObfID, audit.Data{
+				"provider":       provider,
+				"providerUserID": userid,
+			})
+
+		default:
+			log.Printf("Error finding identity: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 			return
 		}
-		fmt.Println("User already in database")
-	}
-
-	fmt.Println("User added to DB")
-
-	session.Values["obfuscated_id"] = obfuscatedID
-	session.Values["user_id"] = userid
-
-	// Save session
-	if err = session.Save(c.Request, c.Writer); err != nil {
-		fmt.Println("Error saving session:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Session error"})
-		return
-	}
 
-	fmt.Println("User Info stored in session")
-	fmt.Println("UserID: ", userid)
-	fmt.Println("Obfuscated UserID: ", obfuscatedID)
+		// the session always carries the account's own id, not the login's,
+		// so every provider lands in the same account
+		if err = sess.Login(c, session.User{UserID: account.OAuthID, ObfID: account.ObfID}); err != nil {
+			fmt.Println("Error saving session:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Session error"})
+			return
+		}
 
-	c.Redirect(http.StatusFound, "/")
-}
+		fmt.Println("User Info stored in session")
+		fmt.Println("UserID: ", account.OAuthID)
+		fmt.Println("Obfuscated UserID: ", account.ObfID)
 
-func LogoutHandler(c *gin.Context) {
-	session, err := store.Get(c.Request, "session-name")
-	if err != nil {
-		fmt.Println(err)
-		return
+		c.Redirect(http.StatusFound, "/")
 	}
-
-	delete(session.Values, "user_id")
-	delete(session.Values, "obfuscated_id")
-	// #nosec G104 -- Ignore specific gosec warning
-	session.Save(c.Request, c.Writer)
-	time.Sleep(3 * time.Second)
-	c.HTML(200, "login.html", gin.H{"Message": "Logged out"})
 }
 
-func DeleteProfile(c *gin.Context) {
-	session, err := store.Get(c.Request, "session-name")
-	if err != nil {
-		fmt.Println("Could not get user session")
-		return
-	}
-
-	userID, ok := session.Values["user_id"].(string)
-	if !ok {
-		fmt.Println(err)
-		return
-	}
+func LogoutHandler(sess *session.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := sess.Logout(c); err != nil {
+			fmt.Println(err)
+			return
+		}
 
-	db, err := db.ConnectToDatabase()
-	if err != nil {
-		log.Fatalf("Error connecting to DB in delete profile: %v", err)
-		return
+		time.Sleep(3 * time.Second)
+		renderLogin(c, 200, "Logged out")
 	}
+}
 
-	stmt, err := db.Prepare("DELETE FROM users WHERE oauthuserid = ?")
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(userID)
-	if err != nil {
-		fmt.Println(err)
-		return
+// generateObfuscatedID makes the id a new account is known by everywhere
+// else in the app. It's random rather than derived from the provider's id,
+// 128 bits so two accounts never share one, and users.obfuscatedid is unique
+// in the DB to make sure
+func generateObfuscatedID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating obfuscated id: %w", err)
 	}
-
-	delete(session.Values, "user_id")
-	delete(session.Values, "obfuscated_id")
-	// #nosec G104 -- Ignore specific gosec warning
-	session.Save(c.Request, c.Writer)
-	defer db.Close()
-
-	time.Sleep(3 * time.Second)
-
-	c.HTML(200, "index.html", gin.H{"Message": "User deleted"})
+	return hex.EncodeToString(b), nil
 }
-
-func generateObfuscatedID(userID string) string {
-	// Create a sha256 hash of the userID
-	hash := sha256.Sum256([]byte(userID))
-	// Take the first 4 bytes (8 characters) of the hash
-	return hex.EncodeToString(hash[:4])
-}
\ No newline at end of file
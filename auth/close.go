@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/audit"
+	"github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/deposit"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/session"
+	"github.com/gin-gonic/gin"
+)
+
+// closeConfirmation is what the player has to type to close their account
+const closeConfirmation = "CLOSE"
+
+// ActiveBets counts the hands a player has money riding on right now. The
+// tables live in main, so it's passed in rather than imported
+type ActiveBets func(obfID string) int
+
+// HoldTables runs fn with the tables held so no bet can go down while it
+// runs, passing how many bets the player has riding. Once fn succeeds the
+// player's bets are refused for good
+type HoldTables func(obfID string, fn func(activeBets int) error) error
+
+// closeBlockers lists what has to be sorted out before the account can be
+// closed. Real money has to be withdrawn first, and deposits on their way
+// have to land, practice chips are just lost
+func closeBlockers(ctx context.Context, books *ledger.Ledger, deposits repo.DepositRepo, activeBets ActiveBets, obfID string) ([]string, error) {
+	balances, err := books.Balances(ctx, obfID)
+	if err != nil {
+		return nil, err
+	}
+
+	var blockers []string
+	for _, cur := range currency.All() {
+		if cur.PlayMoney || balances[cur.Code] <= 0 {
+			continue
+		}
+		blockers = append(blockers, fmt.Sprintf("You still have %s. Withdraw it or contact support before closing.", cur.Display(balances[cur.Code])))
+	}
+	all, err := deposits.ListByUser(ctx, obfID)
+	if err != nil {
+		return nil, err
+	}
+	inFlight := 0
+	for _, d := range all {
+		if deposit.InFlight(d.Status) {
+			inFlight++
+		}
+	}
+	if inFlight > 0 {
+		blockers = append(blockers, fmt.Sprintf("You have %d deposit(s) still being processed. Wait for them to finish before closing.", inFlight))
+	}
+	if n := activeBets(obfID); n > 0 {
+		blockers = append(blockers, fmt.Sprintf("You have %d hand(s) with a bet in play. Finish them before closing.", n))
+	}
+	return blockers, nil
+}
+
+// CloseAccountPageHandler is the confirmation step, it shows anything
+// blocking the closure and the form to go ahead
+func CloseAccountPageHandler(books *ledger.Ledger, deposits repo.DepositRepo, activeBets ActiveBets) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := session.CurrentUser(c)
+
+		blockers, err := closeBlockers(c.Request.Context(), books, deposits, activeBets, user.ObfID)
+		if err != nil {
+			log.Printf("Error checking account closure: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.HTML(200, "close.html", gin.H{
+			"Blockers":     blockers,
+			"Confirmation": closeConfirmation,
+			"CSRFToken":    session.CSRFToken(c),
+		})
+	}
+}
+
+// CloseAccountHandler closes the account once the player has confirmed and
+// nothing is blocking it. The ledger and hand history are kept for the
+// records, the account row is anonymised rather than deleted
+func CloseAccountHandler(users repo.UserRepo, books *ledger.Ledger, deposits repo.DepositRepo, sess *session.Manager, activeBets ActiveBets, holdTables HoldTables, trail *audit.Trail) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		user, _ := session.CurrentUser(c)
+
+		// FormValue so DELETE /deleteaccount?confirm=CLOSE works as well as the form
+		if c.Request.FormValue("confirm") != closeConfirmation {
+			c.HTML(http.StatusBadRequest, "close.html", gin.H{
+				"Message":      "Type " + closeConfirmation + " to confirm.",
+				"Confirmation": closeConfirmation,
+				"CSRFToken":    session.CSRFToken(c),
+			})
+			return
+		}
+
+		blockers, err := closeBlockers(ctx, books, deposits, activeBets, user.ObfID)
+		if err != nil {
+			log.Printf("Error checking account closure: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if len(blockers) > 0 {
+			c.HTML(http.StatusConflict, "close.html", gin.H{
+				"Blockers":     blockers,
+				"Confirmation": closeConfirmation,
+				"CSRFToken":    session.CSRFToken(c),
+			})
+			return
+		}
+
+		// the checks above are for showing the player, these are the ones
+		// that count, made with the tables held and, for deposits, in the
+		// same transaction as the close
+		err = holdTables(user.ObfID, func(bets int) error {
+			if bets > 0 {
+				return repo.ErrAccountBusy
+			}
+			return users.Close(ctx, user.ObfID)
+		})
+		if errors.Is(err, repo.ErrAccountBusy) {
+			// something started since the checks, show what it was
+			blockers, _ = closeBlockers(ctx, books, deposits, activeBets, user.ObfID)
+			c.HTML(http.StatusConflict, "close.html", gin.H{
+				"Blockers":     blockers,
+				"Message":      "Something changed on your account while it was closing. Try again once it's finished.",
+				"Confirmation": closeConfirmation,
+				"CSRFToken":    session.CSRFToken(c),
+			})
+			return
+		}
+		if err != nil && !errors.Is(err, repo.ErrNotFound) {
+			log.Printf("Error closing account: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		trail.RecordOrLog(ctx, audit.TypeAccountClose, user.ObfID, user.ObfID, nil)
+
+		// the account is gone, so is every device signed in to it
+		if _, err := sess.LogoutEverywhere(c); err != nil {
+			log.Print(err)
+		}
+
+		log.Printf("Closed account: obfID=%s", user.ObfID)
+		renderLogin(c, 200, "Your account has been closed.")
+	}
+}
+
+// accountExport is everything the app holds on a player
+type accountExport struct {
+	ExportedAt time.Time
+	Account    struct {
+		ObfID     string
+		Email     string
+		Provider  string
+		CreatedAt time.Time
+	}
+	Identities []repo.Identity
+	Balances   map[string]string
+	Journal    []repo.JournalEntry
+	Hands      []repo.HistoryEntry
+	Sessions   []repo.Session
+}
+
+// ExportHandler hands the player a JSON file of all their data, offered on
+// the close page so they can take a copy first
+func ExportHandler(repos *repo.Repos, sess *session.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		user, _ := session.CurrentUser(c)
+
+		export, err := buildExport(ctx, repos, sess, user)
+		if err != nil {
+			log.Printf("Error exporting account: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		body, err := json.MarshalIndent(export, "", "  ")
+		if err != nil {
+			log.Printf("Error encoding export: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Header("Content-Disposition", "attachment; filename=blackjack-export-"+user.ObfID+".json")
+		c.Data(200, "application/json", body)
+	}
+}
+
+func buildExport(ctx context.Context, repos *repo.Repos, sess *session.Manager, user session.User) (accountExport, error) {
+	export := accountExport{ExportedAt: time.Now()}
+
+	account, err := repos.Users.FindByObfID(ctx, user.ObfID)
+	if err != nil {
+		return export, err
+	}
+	export.Account.ObfID = account.ObfID
+	export.Account.Email = account.Email
+	export.Account.Provider = account.Provider
+	export.Account.CreatedAt = account.CreatedAt
+
+	if export.Identities, err = repos.Users.ListIdentities(ctx, user.ObfID); err != nil {
+		return export, err
+	}
+
+	balances, err := repos.Balances.Balances(ctx, user.ObfID)
+	if err != nil {
+		return export, err
+	}
+	export.Balances = make(map[string]string)
+	for code, amount := range balances {
+		export.Balances[code] = currency.Format(code, amount)
+	}
+
+	if export.Journal, err = repos.Balances.Journal(ctx, user.ObfID); err != nil {
+		return export, err
+	}
+	if export.Hands, err = repos.Games.History(ctx, user.ObfID); err != nil {
+		return export, err
+	}
+	if export.Sessions, err = sess.List(ctx, user.UserID); err != nil {
+		return export, err
+	}
+	return export, nil
+}
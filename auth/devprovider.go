@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/markbates/goth"
+	"golang.org/x/oauth2"
+)
+
+// devUsers are the made up players the dev login page offers
+var devUsers = []string{"alice", "bob", "carol"}
+
+// devProvider is a goth provider that never leaves the machine. Instead of
+// sending the browser to a real provider it shows a page to pick a fake
+// player, then goes through the callback and CompleteAuthHandler like any
+// other login. Config refuses to enable it in production
+type devProvider struct {
+	name    string
+	pickURL string
+}
+
+func newDevProvider(baseURL string) *devProvider {
+	return &devProvider{name: "dev", pickURL: baseURL + "/auth/dev/pick"}
+}
+
+func (p *devProvider) Name() string        { return p.name }
+func (p *devProvider) SetName(name string) { p.name = name }
+func (p *devProvider) Debug(bool)          {}
+
+func (p *devProvider) BeginAuth(state string) (goth.Session, error) {
+	return &devSession{AuthURL: p.pickURL + "?state=" + url.QueryEscape(state)}, nil
+}
+
+func (p *devProvider) UnmarshalSession(data string) (goth.Session, error) {
+	s := &devSession{}
+	err := json.Unmarshal([]byte(data), s)
+	return s, err
+}
+
+func (p *devProvider) FetchUser(session goth.Session) (goth.User, error) {
+	s := session.(*devSession)
+	if s.Username == "" {
+		return goth.User{}, errors.New("no dev user picked")
+	}
+	return goth.User{
+		Provider: p.name,
+		UserID:   "dev-" + s.Username,
+		Name:     s.Username,
+		NickName: s.Username,
+		Email:    s.Username + "@example.com",
+	}, nil
+}
+
+func (p *devProvider) RefreshToken(refreshToken string) (*oauth2.Token, error) {
+	return nil, errors.New("refresh token is not provided by dev")
+}
+
+func (p *devProvider) RefreshTokenAvailable() bool { return false }
+
+// devSession carries the picked player from the pick page to FetchUser
+type devSession struct {
+	AuthURL  string
+	Username string
+}
+
+func (s *devSession) GetAuthURL() (string, error) {
+	return s.AuthURL, nil
+}
+
+func (s *devSession) Marshal() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// Authorize takes the player picked on the form, which comes back as the code
+func (s *devSession) Authorize(provider goth.Provider, params goth.Params) (string, error) {
+	s.Username = strings.ToLower(strings.TrimSpace(params.Get("code")))
+	if s.Username == "" {
+		return "", errors.New("no dev user picked")
+	}
+	return s.Username, nil
+}
+
+// DevPickHandler is the dev provider's stand in for a real login page
+func DevPickHandler(c *gin.Context) {
+	state := c.Query("state")
+	if state == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.HTML(200, "devlogin.html", gin.H{
+		"State": state,
+		"Users": devUsers,
+	})
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/session"
+	"github.com/gin-gonic/gin"
+)
+
+// SessionsHandler lists every device the player is signed in on
+func SessionsHandler(sess *session.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := session.CurrentUser(c)
+
+		sessions, err := sess.List(c.Request.Context(), user.UserID)
+		if err != nil {
+			log.Printf("Error listing sessions: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		rows := make([]gin.H, 0, len(sessions))
+		for _, s := range sessions {
+			rows = append(rows, gin.H{
+				"ID":       s.ID,
+				"Device":   s.UserAgent,
+				"IP":       s.IP,
+				"SignedIn": s.CreatedAt.Format("2006-01-02 15:04"),
+				"LastSeen": s.LastSeen.Format("2006-01-02 15:04"),
+				"Current":  s.ID == user.SessionID,
+			})
+		}
+
+		c.HTML(200, "sessions.html", gin.H{
+			"Sessions":  rows,
+			"CSRFToken": session.CSRFToken(c),
+		})
+	}
+}
+
+// RevokeSessionHandler signs one of the player's other devices out
+func RevokeSessionHandler(sess *session.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := session.CurrentUser(c)
+
+		err := sess.Revoke(c.Request.Context(), user.UserID, c.Param("id"))
+		if errors.Is(err, repo.ErrNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error revoking session: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/sessions")
+	}
+}
+
+// LogoutEverywhereHandler signs the player out on every device, this one included
+func LogoutEverywhereHandler(sess *session.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ended, err := sess.LogoutEverywhere(c)
+		if err != nil {
+			log.Printf("Error logging out everywhere: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Printf("Ended %d sessions\n", ended)
+		renderLogin(c, 200, "Logged out everywhere")
+	}
+}
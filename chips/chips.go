@@ -0,0 +1,48 @@
+package chips
+
+import (
+	"context"
+
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/money"
+)
+
+// Code is the practice currency registered in the currency package
+const Code = "chips"
+
+// DailyAllowance is what the chips wallet is refilled to once a day
+const DailyAllowance money.Amount = 1000
+
+// TopUp refills the player's chips wallet to DailyAllowance if it hasn't
+// been refilled yet today. Players with more than the allowance keep it.
+// Called before a chips bet, only the first call of the day does anything
+func TopUp(ctx context.Context, l *ledger.Ledger, obfID string) error {
+	_, err := l.TopUp(ctx, obfID, Code, DailyAllowance)
+	return err
+}
+
+// Standing is one row of the chips leaderboard
+type Standing struct {
+	Rank  int
+	ObfID string
+	Chips money.Amount
+}
+
+// Leaderboard returns the players holding the most chips. It only ever looks
+// at the chips currency, real balances never show up here
+func Leaderboard(ctx context.Context, l *ledger.Ledger, limit int) ([]Standing, error) {
+	top, err := l.TopBalances(ctx, Code, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	standings := make([]Standing, 0, len(top))
+	for i, s := range top {
+		standings = append(standings, Standing{
+			Rank:  i + 1,
+			ObfID: s.ObfID,
+			Chips: s.Amount,
+		})
+	}
+	return standings, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/admin"
+	"github.com/Scrimzay/blackjackgame/audit"
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/db"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/migrations"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/solana"
+)
+
+// runCommand handles `blackjackgame [flags] <command>` for jobs that run once and
+// exit instead of starting the server
+func runCommand(cfg *config.Config, args []string) {
+	switch args[0] {
+	case "reconcile":
+		reconcileCommand(cfg)
+	case "migrate":
+		migrateCommand(cfg, args[1:])
+	case "role":
+		roleCommand(cfg, args[1:])
+	case "audit":
+		auditCommand(cfg, args[1:])
+	case "solana":
+		solanaCommand(cfg, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, "Commands: reconcile, migrate [up|down [n]|status|baseline <version>], role <obfID> <player|support|admin>, audit verify, solana stub [addr]")
+		os.Exit(2)
+	}
+}
+
+// migrateCommand runs the schema migrations, `migrate` on its own is `migrate up`
+func migrateCommand(cfg *config.Config, args []string) {
+	database, err := db.Open(cfg.DB)
+	if err != nil {
+		log.Fatalf("Error connecting to DB in migrate: %v", err)
+	}
+	defer database.Close()
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "up":
+		applied, err := migrations.Up(database)
+		if err != nil {
+			log.Fatalf("Error migrating up: %v", err)
+		}
+		fmt.Printf("Applied %d migrations\n", applied)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid number of migrations to roll back: %s", args[1])
+			}
+		}
+		rolledBack, err := migrations.Down(database, steps)
+		if err != nil {
+			log.Fatalf("Error migrating down: %v", err)
+		}
+		fmt.Printf("Rolled back %d migrations\n", rolledBack)
+
+	case "status":
+		statuses, err := migrations.List(database)
+		if err != nil {
+			log.Fatalf("Error reading migration status: %v", err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+
+	case "baseline":
+		// for a database built from the SQL files that were run by hand
+		// before there was a migration runner, it checks what's there
+		// before marking anything
+		if len(args) < 2 {
+			log.Fatalf("Usage: migrate baseline <version>")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 1 {
+			log.Fatalf("Invalid migration version: %s", args[1])
+		}
+		marked, err := migrations.Baseline(database, version)
+		if err != nil {
+			log.Fatalf("Error baselining migrations: %v", err)
+		}
+		fmt.Printf("Marked %d migrations as applied\n", marked)
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown migrate action: %s\n", action)
+		os.Exit(2)
+	}
+}
+
+// reconcileCommand checks the balance table against the ledger and exits
+// non-zero if anything has drifted
+func reconcileCommand(cfg *config.Config) {
+	database, err := db.Open(cfg.DB)
+	if err != nil {
+		log.Fatalf("Error connecting to DB in reconcile: %v", err)
+	}
+	defer database.Close()
+
+	repos := repo.NewPostgres(database)
+	books := ledger.New(repos.Balances)
+	report, err := books.Reconcile(context.Background())
+	if err != nil {
+		log.Fatalf("Error reconciling ledger: %v", err)
+	}
+
+	for _, d := range report.Drifts {
+		fmt.Printf("DRIFT obfID=%s currency=%s balance=%s journal=%s diff=%s\n",
+			d.ObfID, d.Currency, currency.Format(d.Currency, d.Balance),
+			currency.Format(d.Currency, d.Journal), currency.Format(d.Currency, d.Balance-d.Journal))
+	}
+	for _, txID := range report.Unbalanced {
+		fmt.Printf("UNBALANCED txID=%s\n", txID)
+	}
+
+	if !report.OK() {
+		fmt.Printf("Reconciliation failed: %d drifted balances, %d unbalanced transactions\n",
+			len(report.Drifts), len(report.Unbalanced))
+		os.Exit(1)
+	}
+	fmt.Println("Ledger reconciled, no drift")
+}
+
+// roleCommand sets an account's role from the shell, which is how the first
+// admin gets made. It's audited like a change made through /admin
+func roleCommand(cfg *config.Config, args []string) {
+	if len(args) != 2 || !admin.ValidRole(args[1]) {
+		fmt.Fprintln(os.Stderr, "Usage: role <obfID> <player|support|admin>")
+		os.Exit(2)
+	}
+	obfID, role := args[0], args[1]
+
+	database, err := db.Open(cfg.DB)
+	if err != nil {
+		log.Fatalf("Error connecting to DB in role: %v", err)
+	}
+	defer database.Close()
+
+	ctx := context.Background()
+	repos := repo.NewPostgres(database)
+	account, err := repos.Users.FindByObfID(ctx, obfID)
+	if err != nil {
+		log.Fatalf("Error finding user %s: %v", obfID, err)
+	}
+	if err := repos.Users.SetRole(ctx, obfID, role); err != nil {
+		log.Fatalf("Error setting role: %v", err)
+	}
+	err = repos.Audit.Append(ctx, repo.AuditEntry{
+		Actor:  "cli",
+		Action: "set_role",
+		Target: obfID,
+		Detail: account.Role + " -> " + role,
+	})
+	if err != nil {
+		log.Fatalf("Role set but not audited: %v", err)
+	}
+	err = audit.New(repos.Events).Record(ctx, audit.TypeAdmin, audit.ActorCLI, obfID, audit.Data{
+		"action": "set_role",
+		"detail": account.Role + " -> " + role,
+	})
+	if err != nil {
+		log.Fatalf("Role set but not in the audit trail: %v", err)
+	}
+	fmt.Printf("%s is now %s\n", obfID, role)
+}
+
+// auditCommand checks the audit trail's hash chain end to end and exits
+// non-zero if anything has been changed, removed or reordered
+func auditCommand(cfg *config.Config, args []string) {
+	if len(args) != 1 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: audit verify")
+		os.Exit(2)
+	}
+
+	database, err := db.Open(cfg.DB)
+	if err != nil {
+		log.Fatalf("Error connecting to DB in audit: %v", err)
+	}
+	defer database.Close()
+
+	// whatever the postings have queued goes on the end first, so it's
+	// checked too
+	events := repo.NewPostgres(database).Events
+	if _, err := audit.New(events).Chain(context.Background()); err != nil {
+		log.Fatalf("Error verifying audit trail: %v", err)
+	}
+	report, err := audit.Verify(context.Background(), events)
+	if err != nil {
+		log.Fatalf("Error verifying audit trail: %v", err)
+	}
+
+	for _, p := range report.Problems {
+		fmt.Printf("TAMPERED seq=%d %s\n", p.Seq, p.Reason)
+	}
+	if !report.OK() {
+		fmt.Printf("Audit trail verification failed: %d problems in %d events\n", len(report.Problems), report.Events)
+		os.Exit(1)
+	}
+	fmt.Printf("Audit trail verified, %d events, head %s\n", report.Events, report.Head)
+}
+
+// solanaCommand runs a stand-in Solana node to check deposits against in
+// development, point SOLANA_RPC_URL at it. Its stubTransfer method fakes a
+// transfer, e.g.
+//
+//	curl localhost:8899 -d '{"jsonrpc":"2.0","id":1,"method":"stubTransfer","params":["<from>","<to>",1000000000]}'
+func solanaCommand(cfg *config.Config, args []string) {
+	if len(args) < 1 || len(args) > 2 || args[0] != "stub" {
+		fmt.Fprintln(os.Stderr, "Usage: solana stub [addr]")
+		os.Exit(2)
+	}
+	if cfg.IsProd() {
+		log.Fatal("The stub Solana node can't be run in production")
+	}
+	addr := ":8899"
+	if len(args) == 2 {
+		addr = args[1]
+	}
+
+	fmt.Printf("Stub Solana node listening on %s\n", addr)
+	if err := http.ListenAndServe(addr, solana.NewStub()); err != nil {
+		log.Fatalf("Error running stub Solana node: %v", err)
+	}
+}
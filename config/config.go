@@ -0,0 +1,445 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// what the reaper does with a bet that is still riding when its table expires
+const (
+	ExpiryStand  = "stand"  // play the hand out as if the player stood
+	ExpiryRefund = "refund" // hand the bet back to the player
+)
+
+// Config is everything the server reads from its environment, loaded once
+// at startup and handed to each subsystem. Nothing else should call
+// os.Getenv or load .env
+type Config struct {
+	Env           string // "development" or "production"
+	ListenAddr    string
+	BaseURL       string // where players reach the site, used for OAuth callbacks
+	SessionSecret string
+	Sessions      Sessions
+	DB            DB
+	Providers     []Provider
+	Tables        Tables
+	Payments      Payments
+	Solana        Solana
+}
+
+// Sessions sets how long a sign in lasts. A session ends after IdleTimeout
+// without a request, or AbsoluteTimeout after sign in however busy it is
+type Sessions struct {
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+}
+
+// DB picks the storage backend and tunes the Postgres pool
+type DB struct {
+	Backend         string // "postgres" or "memory"
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	MigrateOnStart  bool
+}
+
+// Provider is the OAuth app registered with one login provider
+type Provider struct {
+	Name         string
+	Label        string // what the login page calls it
+	Key          string
+	Secret       string
+	DiscoveryURL string // oidc only, the issuer's .well-known/openid-configuration
+}
+
+// providerLabels are the providers the server knows how to talk to
+var providerLabels = map[string]string{
+	"spotify": "Spotify",
+	"google":  "Google",
+	"github":  "GitHub",
+	"discord": "Discord",
+	"oidc":    "Single Sign-On",
+	"dev":     "Dev Login", // fake players for local development, never in production
+}
+
+// Tables are the defaults every new blackjack table starts with
+type Tables struct {
+	Decks        int
+	IdleTTL      time.Duration
+	ExpiryPolicy string
+}
+
+// what the simulated payment processor does with a card that isn't one of
+// its test numbers
+const (
+	SimulateApprove = "approve"
+	SimulateDecline = "decline"
+	SimulateDelay   = "delay" // answer pending, then approve by webhook after SimulateDelay
+)
+
+// Payments picks who card deposits are charged through. The server never
+// keeps card details, the processor swaps them for a token
+type Payments struct {
+	Processor     string // "remote" or "simulated"
+	APIURL        string // the remote processor's API
+	APIKey        string
+	WebhookSecret string // signs the webhooks the processor sends us, the simulator makes one up if it's empty
+	Simulate      string
+	SimulateDelay time.Duration
+}
+
+// Solana is the node deposits are watched on and the key every player's
+// deposit address is derived from. Leaving RPCURL empty turns Solana
+// deposits off
+type Solana struct {
+	RPCURL        string // a JSON-RPC endpoint, `blackjackgame solana stub` runs a local one
+	MasterKey     string // losing or changing it loses every deposit address
+	Confirmations int    // slots that have to land on top of a transfer before it's credited
+	PollInterval  time.Duration
+}
+
+// IsProd reports whether the server is running in production, which turns
+// on secure cookies and the stricter checks in Load
+func (c *Config) IsProd() bool {
+	return c.Env == "production"
+}
+
+// HasProvider reports whether the named login provider is enabled
+func (c *Config) HasProvider(name string) bool {
+	for _, p := range c.Providers {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CallbackURL is where the provider sends the player back after login
+func (c *Config) CallbackURL(provider string) string {
+	return c.BaseURL + "/auth/" + provider + "/callback"
+}
+
+// flags maps each command line flag to the setting it overrides
+var flags = []struct {
+	name, key, usage string
+}{
+	{"config", "CONFIG_FILE", "env file to read settings from"},
+	{"env", "APP_ENV", "development or production"},
+	{"listen", "LISTEN_ADDR", "address the server listens on"},
+	{"base-url", "BASE_URL", "public URL of the site"},
+	{"db-backend", "DB_BACKEND", "postgres or memory"},
+}
+
+// Load reads the config from, lowest priority first, the defaults, an env
+// file (CONFIG_FILE, .env if it exists), the environment and the command line
+// flags in args. It returns whatever args are left after the flags, and every
+// problem it found rather than just the first
+func Load(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("blackjackgame", flag.ContinueOnError)
+	for _, f := range flags {
+		fs.String(f.name, "", f.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	src := source{flags: make(map[string]string)}
+	fs.Visit(func(f *flag.Flag) {
+		for _, known := range flags {
+			if known.name == f.Name {
+				src.flags[known.key] = f.Value.String()
+			}
+		}
+	})
+
+	// the env file is optional unless someone asked for a specific one
+	file := src.str("CONFIG_FILE", "")
+	if file == "" {
+		file = ".env"
+		if _, err := os.Stat(file); err != nil {
+			file = ""
+		}
+	}
+	if file != "" {
+		values, err := godotenv.Read(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading config file %s: %w", file, err)
+		}
+		src.file = values
+	}
+
+	cfg := &Config{
+		Env:           src.str("APP_ENV", "development"),
+		ListenAddr:    src.str("LISTEN_ADDR", ":3000"),
+		BaseURL:       strings.TrimSuffix(src.str("BASE_URL", "http://localhost:3000"), "/"),
+		SessionSecret: src.str("SESSION_SECRET", ""),
+		Sessions: Sessions{
+			IdleTimeout:     src.duration("SESSION_IDLE_TIMEOUT", 24*time.Hour),
+			AbsoluteTimeout: src.duration("SESSION_ABSOLUTE_TIMEOUT", 30*24*time.Hour),
+		},
+		DB: DB{
+			Backend:         src.str("DB_BACKEND", "postgres"),
+			DSN:             src.dsn(),
+			MaxOpenConns:    src.int("DB_MAX_OPEN_CONNS", 25),
+			MaxIdleConns:    src.int("DB_MAX_IDLE_CONNS", 5),
+			ConnMaxLifetime: src.duration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+			MigrateOnStart:  src.bool("MIGRATE_ON_START", true),
+		},
+		Tables: Tables{
+			Decks:        src.int("TABLE_DECKS", 3),
+			IdleTTL:      src.duration("GAME_IDLE_TTL", 30*time.Minute),
+			ExpiryPolicy: src.str("GAME_EXPIRY_POLICY", ExpiryRefund),
+		},
+		Payments: Payments{
+			Processor:     src.str("PAYMENT_PROCESSOR", "simulated"),
+			APIURL:        strings.TrimSuffix(src.str("PAYMENT_API_URL", ""), "/"),
+			APIKey:        src.str("PAYMENT_API_KEY", ""),
+			WebhookSecret: src.str("PAYMENT_WEBHOOK_SECRET", ""),
+			Simulate:      src.str("PAYMENT_SIMULATE", SimulateApprove),
+			SimulateDelay: src.duration("PAYMENT_SIMULATE_DELAY", 5*time.Second),
+		},
+		Solana: Solana{
+			RPCURL:        src.str("SOLANA_RPC_URL", ""),
+			MasterKey:     src.str("SOLANA_MASTER_KEY", ""),
+			Confirmations: src.int("SOLANA_CONFIRMATIONS", 32),
+			PollInterval:  src.duration("SOLANA_POLL_INTERVAL", 10*time.Second),
+		},
+	}
+
+	for _, name := range strings.Split(src.str("AUTH_PROVIDERS", "spotify"), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		prefix := strings.ToUpper(name)
+		cfg.Providers = append(cfg.Providers, Provider{
+			Name:         name,
+			Label:        src.str(prefix+"_LABEL", providerLabels[name]),
+			Key:          src.str(prefix+"_ID", ""),
+			Secret:       src.str(prefix+"_SECRET", ""),
+			DiscoveryURL: src.str(prefix+"_DISCOVERY_URL", ""),
+		})
+	}
+
+	errs := append(src.errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return cfg, fs.Args(), nil
+}
+
+func (c *Config) validate() []error {
+	var errs []error
+
+	switch c.Env {
+	case "development", "production":
+	default:
+		errs = append(errs, fmt.Errorf("APP_ENV must be development or production, got %q", c.Env))
+	}
+
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("LISTEN_ADDR is required"))
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("BASE_URL must be an absolute URL, got %q", c.BaseURL))
+	} else if c.IsProd() && u.Scheme != "https" {
+		errs = append(errs, errors.New("BASE_URL must be https in production"))
+	}
+
+	if c.SessionSecret == "" {
+		errs = append(errs, errors.New("SESSION_SECRET is required"))
+	} else if c.IsProd() && len(c.SessionSecret) < 32 {
+		errs = append(errs, errors.New("SESSION_SECRET must be at least 32 characters in production"))
+	}
+
+	if c.Sessions.IdleTimeout <= 0 || c.Sessions.AbsoluteTimeout <= 0 {
+		errs = append(errs, errors.New("SESSION_IDLE_TIMEOUT and SESSION_ABSOLUTE_TIMEOUT must be positive"))
+	} else if c.Sessions.IdleTimeout > c.Sessions.AbsoluteTimeout {
+		errs = append(errs, errors.New("SESSION_IDLE_TIMEOUT can't be longer than SESSION_ABSOLUTE_TIMEOUT"))
+	}
+
+	switch c.DB.Backend {
+	case "postgres":
+		if c.DB.DSN == "" {
+			errs = append(errs, errors.New("DATABASE_URL or DBNAME is required for the postgres backend"))
+		}
+	case "memory":
+		if c.IsProd() {
+			errs = append(errs, errors.New("the memory backend can't be used in production"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("DB_BACKEND must be postgres or memory, got %q", c.DB.Backend))
+	}
+
+	if len(c.Providers) == 0 {
+		errs = append(errs, errors.New("AUTH_PROVIDERS needs at least one provider"))
+	}
+	seen := make(map[string]bool)
+	for _, p := range c.Providers {
+		prefix := strings.ToUpper(p.Name)
+		if _, ok := providerLabels[p.Name]; !ok {
+			errs = append(errs, fmt.Errorf("AUTH_PROVIDERS has unknown provider %q", p.Name))
+			continue
+		}
+		if seen[p.Name] {
+			errs = append(errs, fmt.Errorf("AUTH_PROVIDERS lists %s twice", p.Name))
+		}
+		seen[p.Name] = true
+		if p.Name == "dev" {
+			if c.IsProd() {
+				errs = append(errs, errors.New("the dev provider can't be used in production"))
+			}
+			continue
+		}
+		if p.Key == "" || p.Secret == "" {
+			errs = append(errs, fmt.Errorf("%s_ID and %s_SECRET are required for the %s provider", prefix, prefix, p.Name))
+		}
+		if p.Name == "oidc" && p.DiscoveryURL == "" {
+			errs = append(errs, errors.New("OIDC_DISCOVERY_URL is required for the oidc provider"))
+		}
+	}
+
+	if c.Tables.Decks < 1 || c.Tables.Decks > 8 {
+		errs = append(errs, fmt.Errorf("TABLE_DECKS must be between 1 and 8, got %d", c.Tables.Decks))
+	}
+	if c.Tables.IdleTTL <= 0 {
+		errs = append(errs, errors.New("GAME_IDLE_TTL must be positive"))
+	}
+	switch c.Tables.ExpiryPolicy {
+	case ExpiryStand, ExpiryRefund:
+	default:
+		errs = append(errs, fmt.Errorf("GAME_EXPIRY_POLICY must be %s or %s, got %q", ExpiryStand, ExpiryRefund, c.Tables.ExpiryPolicy))
+	}
+
+	switch c.Payments.Processor {
+	case "remote":
+		if u, err := url.Parse(c.Payments.APIURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("PAYMENT_API_URL must be an https URL, got %q", c.Payments.APIURL))
+		}
+		if c.Payments.APIKey == "" || c.Payments.WebhookSecret == "" {
+			errs = append(errs, errors.New("PAYMENT_API_KEY and PAYMENT_WEBHOOK_SECRET are required for the remote payment processor"))
+		}
+	case "simulated":
+		if c.IsProd() {
+			errs = append(errs, errors.New("the simulated payment processor can't be used in production"))
+		}
+		switch c.Payments.Simulate {
+		case SimulateApprove, SimulateDecline, SimulateDelay:
+		default:
+			errs = append(errs, fmt.Errorf("PAYMENT_SIMULATE must be %s, %s or %s, got %q",
+				SimulateApprove, SimulateDecline, SimulateDelay, c.Payments.Simulate))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("PAYMENT_PROCESSOR must be remote or simulated, got %q", c.Payments.Processor))
+	}
+
+	if c.Solana.RPCURL != "" {
+		if u, err := url.Parse(c.Solana.RPCURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("SOLANA_RPC_URL must be an absolute URL, got %q", c.Solana.RPCURL))
+		} else if c.IsProd() && u.Scheme != "https" {
+			errs = append(errs, errors.New("SOLANA_RPC_URL must be https in production"))
+		}
+		if len(c.Solana.MasterKey) < 32 {
+			errs = append(errs, errors.New("SOLANA_MASTER_KEY must be at least 32 characters when SOLANA_RPC_URL is set"))
+		}
+		if c.Solana.Confirmations < 1 {
+			errs = append(errs, errors.New("SOLANA_CONFIRMATIONS must be at least 1"))
+		}
+		if c.Solana.PollInterval <= 0 {
+			errs = append(errs, errors.New("SOLANA_POLL_INTERVAL must be positive"))
+		}
+	}
+
+	return errs
+}
+
+// source looks a setting up in the flags, then the environment, then the
+// env file, and collects parse errors instead of stopping at the first
+type source struct {
+	flags map[string]string
+	file  map[string]string
+	errs  []error
+}
+
+func (s *source) lookup(key string) (string, bool) {
+	if v, ok := s.flags[key]; ok {
+		return v, true
+	}
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v, true
+	}
+	if v, ok := s.file[key]; ok && v != "" {
+		return v, true
+	}
+	return "", false
+}
+
+func (s *source) str(key, fallback string) string {
+	if v, ok := s.lookup(key); ok {
+		return v
+	}
+	return fallback
+}
+
+func (s *source) int(key string, fallback int) int {
+	v, ok := s.lookup(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		s.errs = append(s.errs, fmt.Errorf("%s must be a whole number, got %q", key, v))
+		return fallback
+	}
+	return n
+}
+
+func (s *source) duration(key string, fallback time.Duration) time.Duration {
+	v, ok := s.lookup(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		s.errs = append(s.errs, fmt.Errorf("%s must be a duration like 30m, got %q", key, v))
+		return fallback
+	}
+	return d
+}
+
+func (s *source) bool(key string, fallback bool) bool {
+	v, ok := s.lookup(key)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s must be true or false, got %q", key, v))
+		return fallback
+	}
+	return b
+}
+
+// dsn prefers DATABASE_URL and falls back to the HOST, PORT, USER, PASSWORD
+// and DBNAME settings the server has always used
+func (s *source) dsn() string {
+	if dsn := s.str("DATABASE_URL", ""); dsn != "" {
+		return dsn
+	}
+	dbname := s.str("DBNAME", "")
+	if dbname == "" {
+		return ""
+	}
+	port := s.int("PORT", 5432)
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		s.str("HOST", "localhost"), port, s.str("USER", ""), s.str("PASSWORD", ""), dbname)
+}
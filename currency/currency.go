@@ -0,0 +1,137 @@
+package currency
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Scrimzay/blackjackgame/money"
+)
+
+// Currency is everything the handlers and templates need to know about a
+// currency. Balances are keyed by Code, so adding one here is enough to make
+// it bettable
+type Currency struct {
+	Code         string // stored in balances.currency and sent by the bet form
+	Name         string // shown in the currency pickers
+	Symbol       string
+	SymbolSuffix bool         // "1.50 SOL" rather than "$1.50"
+	Decimals     int          // decimal places of the minor unit
+	MinBet       money.Amount // in minor units, 0 means no minimum
+	MaxBet       money.Amount // in minor units, 0 means no maximum
+	Order        int          // position in the pickers
+	PlayMoney    bool         // practice currency with no real value, never deposited or withdrawn
+}
+
+var (
+	registry   = make(map[string]Currency)
+	registryMu sync.RWMutex
+)
+
+func init() {
+	Register(Currency{
+		Code:     "cash",
+		Name:     "Cash (USD)",
+		Symbol:   "$",
+		Decimals: 2,
+		MinBet:   100,     // $1
+		MaxBet:   1000000, // $10,000
+		Order:    0,
+	})
+	Register(Currency{
+		Code:         "solana",
+		Name:         "Solana (SOL)",
+		Symbol:       "SOL",
+		SymbolSuffix: true,
+		Decimals:     9,
+		MinBet:       1000000,      // 0.001 SOL
+		MaxBet:       100000000000, // 100 SOL
+		Order:        1,
+	})
+	Register(Currency{
+		Code:         "chips",
+		Name:         "Practice Chips (play money)",
+		Symbol:       "chips",
+		SymbolSuffix: true,
+		Decimals:     0,
+		MinBet:       10,
+		MaxBet:       1000,
+		Order:        2,
+		PlayMoney:    true,
+	})
+}
+
+// Register adds or replaces a currency
+func Register(c Currency) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[c.Code] = c
+}
+
+// Lookup finds a registered currency by code
+func Lookup(code string) (Currency, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	c, ok := registry[code]
+	return c, ok
+}
+
+// All returns every registered currency in picker order
+func All() []Currency {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	all := make([]Currency, 0, len(registry))
+	for _, c := range registry {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Order != all[j].Order {
+			return all[i].Order < all[j].Order
+		}
+		return all[i].Code < all[j].Code
+	})
+	return all
+}
+
+// Parse turns a decimal string into minor units of the currency
+func (c Currency) Parse(s string) (money.Amount, error) {
+	return money.Parse(c.Decimals, s)
+}
+
+// Format turns minor units into a plain decimal string
+func (c Currency) Format(a money.Amount) string {
+	return money.Format(c.Decimals, a)
+}
+
+// Display formats an amount with the currency symbol for the UI
+func (c Currency) Display(a money.Amount) string {
+	if c.SymbolSuffix {
+		return c.Format(a) + " " + c.Symbol
+	}
+	return c.Symbol + c.Format(a)
+}
+
+// CheckBet makes sure a bet is inside the currency's table limits
+func (c Currency) CheckBet(a money.Amount) error {
+	if a <= 0 {
+		return fmt.Errorf("bet must be more than zero")
+	}
+	if c.MinBet > 0 && a < c.MinBet {
+		return fmt.Errorf("minimum bet is %s", c.Display(c.MinBet))
+	}
+	if c.MaxBet > 0 && a > c.MaxBet {
+		return fmt.Errorf("maximum bet is %s", c.Display(c.MaxBet))
+	}
+	return nil
+}
+
+// Format formats an amount in the currency with the given code, for log
+// lines that may see a code that isn't registered
+func Format(code string, a money.Amount) string {
+	c, ok := Lookup(code)
+	if !ok {
+		return strconv.FormatInt(int64(a), 10)
+	}
+	return c.Format(a)
+}
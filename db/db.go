@@ -3,21 +3,13 @@ package db
 import (
 	"database/sql"
 	"fmt"
-	"os"
-	"strconv"
 
-	"github.com/joho/godotenv"
+	"github.com/Scrimzay/blackjackgame/config"
 	_ "github.com/lib/pq"
 	"github.com/Scrimzay/loglogger"
 )
 
 var (
-	db *sql.DB
-	host     string
-	port     int
-	user     string
-	password string
-	dbname   string
 	log *logger.Logger
 )
 
@@ -29,37 +21,25 @@ func init() {
 	}
 }
 
-func ConnectToDatabase() (*sql.DB, error) {
-	err := godotenv.Load(".env")
-	if err != nil {
-		return nil, fmt.Errorf("Could not load .env file in db: %v", err)
-	}
-
-	// Fetch and parse environment variables
-	host = os.Getenv("HOST")
-	user = os.Getenv("USER")
-	password = os.Getenv("PASSWORD")
-	dbname = os.Getenv("DBNAME")
-	portStr := os.Getenv("PORT")
-	port, err = strconv.Atoi(portStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid port value: %w", err)
-	}
-
-	// Build the connection string
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-
+// Open creates the connection pool the whole server shares. Call it once at
+// startup and hand the *sql.DB to whatever needs it, never per request
+func Open(cfg config.DB) (*sql.DB, error) {
 	// Open the database connection
-	db, err = sql.Open("postgres", psqlInfo)
+	db, err := sql.Open("postgres", cfg.DSN)
 	if err != nil {
 		return nil, fmt.Errorf("error opening database: %w", err)
 	}
 
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
 	// Verify the connection
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("error connecting to the database: %w", err)
 	}
 
+	log.Printf("Connected to the database, max open conns %d", cfg.MaxOpenConns)
 	return db, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,96 @@
+package deposit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Card is the card details as the player typed them. It only lives for the
+// length of the deposit request, long enough to hand to the processor for a
+// token. It never goes to the DB, and it prints masked so it can't end up in
+// a log by accident either
+type Card struct {
+	Number         string
+	CVV            string
+	ExpMonth       int
+	ExpYear        int
+	Name           string
+	BillingAddress string
+}
+
+// Last4 is the only part of the number that's safe to show or keep
+func (c Card) Last4() string {
+	if len(c.Number) < 4 {
+		return ""
+	}
+	return c.Number[len(c.Number)-4:]
+}
+
+// String masks everything but the last 4 digits
+func (c Card) String() string {
+	return "card ending " + c.Last4()
+}
+
+// GoString masks %#v as well
+func (c Card) GoString() string {
+	return c.String()
+}
+
+// Format masks every verb, so even %+v shows no card data
+func (c Card) Format(f fmt.State, verb rune) {
+	fmt.Fprint(f, c.String())
+}
+
+// parseCard reads and checks the card fields from the deposit form
+func parseCard(number, cvv, expiry, name, billingAddress string) (Card, error) {
+	// people type spaces and dashes between the groups of digits
+	number = strings.NewReplacer(" ", "", "-", "").Replace(number)
+	if len(number) < 12 || len(number) > 19 || !luhn(number) {
+		return Card{}, errors.New("invalid card number")
+	}
+	if len(cvv) < 3 || len(cvv) > 4 || strings.Trim(cvv, "0123456789") != "" {
+		return Card{}, errors.New("invalid CVV")
+	}
+
+	// the form's month input sends 2027-05
+	exp, err := time.Parse("2006-01", expiry)
+	if err != nil {
+		return Card{}, errors.New("invalid expiry date")
+	}
+	// a card is good until the end of its expiry month
+	if time.Now().After(exp.AddDate(0, 1, 0)) {
+		return Card{}, errors.New("card has expired")
+	}
+
+	return Card{
+		Number:         number,
+		CVV:            cvv,
+		ExpMonth:       int(exp.Month()),
+		ExpYear:        exp.Year(),
+		Name:           strings.TrimSpace(name),
+		BillingAddress: strings.TrimSpace(billingAddress),
+	}, nil
+}
+
+// luhn is the card number checksum, it catches typos before the processor does
+func luhn(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -1,23 +1,26 @@
 package deposit
 
 import (
-	"os"
-	"fmt"
+	"errors"
 	"net/http"
-	"strconv"
 
-	"github.com/Scrimzay/blackjackgame/db"
-	"github.com/gorilla/sessions"
-	"github.com/joho/godotenv"
+	"github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/session"
 	"github.com/Scrimzay/loglogger"
 	"github.com/gin-gonic/gin"
 )
 
 var (
-	store *sessions.CookieStore
 	log *logger.Logger
 )
 
+// currency credited by each deposit type taken through the form, Solana
+// deposits come in through the watcher instead
+var depositCurrencies = map[string]string{
+	"card": "cash",
+}
+
 func init() {
 	var err error
 	log, err = logger.New("bettinglog.txt")
@@ -26,156 +29,194 @@ func init() {
 	}
 }
 
-func DepositPOSTHandler(c *gin.Context) {
-	fmt.Println("***DEPOSIT POST HANDLER RUNNING***")
-	// Get the users session
-	err := godotenv.Load(".env")
-	if err != nil {
-		log.Fatalf("Error loading .env file in auth: %v", err)
-	}
-	sessionKey := os.Getenv("SESSION_SECRET")
-	if sessionKey == "" {
-		log.Fatal("Session secret not loaded.")
-		return
-	}
-	store = sessions.NewCookieStore([]byte(sessionKey))
-	session, err := store.Get(c.Request, "session-name")
-	if err != nil {
-		fmt.Println("Error getting session, most likely not signed in")
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-
-	obfID, ok := session.Values["obfuscated_id"].(string)
-	if !ok {
-		log.Print(err)
-		return
-	}
-
-	// parse the deposit type from the form
-	depositType := c.PostForm("depositType")
+// DepositPOSTHandler takes a card deposit. Cards are charged through the
+// processor, which is the only thing that ever sees the card details. sol is
+// nil when Solana is turned off
+func DepositPOSTHandler(svc *Service, sol *Solana) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		// the signed in user, put there by the session middleware
+		user, ok := session.CurrentUser(c)
+		if !ok {
+			log.Print("Deposit without a signed in user")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		obfID := user.ObfID
 
-	db, err := db.ConnectToDatabase()
-	if err != nil {
-		log.Fatalf("Error connecting to DB in depostPOSTHandler: %v", err)
-		return
-	}
+		// parse the deposit type from the form
+		depositType := c.PostForm("depositType")
 
-	// process the deposit based on the deposit type
-	switch depositType {
-	case "solana":
-		// parse solana deposit false
-		walletAddress := c.PostForm("walletAddress")
-		amountStr := c.PostForm("solanaAmount")
-		if amountStr == "" {
-			log.Print("Amount is missing in the request")
+		// the currency this deposit type credits
+		cur, ok := currency.Lookup(depositCurrencies[depositType])
+		if !ok {
+			log.Print("Invalid deposit type:", depositType)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		// validate the amount
-		amount, err := strconv.ParseFloat(amountStr, 64)
-		if err != nil || amount <= 0 {
-			log.Print("Invalid amount:", err)
+		// process the deposit based on the deposit type
+		switch depositType {
+		case "card":
+			amountStr := c.PostForm("cardAmount")
+			if amountStr == "" {
+				log.Print("Amount is missing in the request")
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+
+			// validate amount
+			amount, err := cur.Parse(amountStr)
+			if err != nil || amount <= 0 {
+				log.Print("Invalid amount:", err)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+
+			// the card details go straight to the processor for a token and
+			// aren't kept, logged or stored anywhere after this
+			card, err := parseCard(c.PostForm("cardNumber"), c.PostForm("cvv"), c.PostForm("expiry"),
+				c.PostForm("name"), c.PostForm("billingAddress"))
+			if err != nil {
+				renderDeposit(c, sol, http.StatusBadRequest, err.Error())
+				return
+			}
+			d, err := svc.StartCard(ctx, obfID, card, amount, cur.Code)
+			if err != nil {
+				log.Printf("Error starting card deposit: obfID=%s, id=%s: %v", obfID, d.ID, err)
+				if d.ID == "" {
+					renderDeposit(c, sol, http.StatusBadGateway, "We couldn't reach the card processor, please try again.")
+					return
+				}
+			}
+
+			// the status page follows it from here, whether it's settled yet or not
+			c.Redirect(http.StatusSeeOther, "/deposit/"+d.ID)
+			return
+
+		default:
+			log.Print("Invalid deposit type:", depositType)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
+	}
+}
 
-		// update solana balance
-		query := `
-			update balance
-			set solana_balance = solana_balance + $1
-			where obfuscatedid = $2
-		`
+// DepositStatusHandler shows where one of the user's deposits is. The page
+// keeps refreshing itself while it's pending
+func DepositStatusHandler(svc *Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := session.CurrentUser(c)
+		if !ok {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
 
-		res, err := db.Exec(query, amount, obfID)
+		d, err := svc.Find(c.Request.Context(), c.Param("id"))
+		// someone else's deposit looks the same as one that doesn't exist
+		if errors.Is(err, repo.ErrNotFound) || (err == nil && d.ObfID != user.ObfID) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			log.Printf("Error updating balance: %v", err)
+			log.Printf("Error finding deposit %s: %v", c.Param("id"), err)
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
-		rowsAffected, _ := res.RowsAffected()
-		if rowsAffected == 0 {
-			query := `
-			insert into balance
-			(obfuscatedid, solana_balance)
-			values ($1, $2)
-			`
-			_, err := db.Exec(query, obfID, amount)
-			if err != nil {
-				log.Printf("Error inserting balance: %v", err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return
-			}
+		// where the money came from, as the player would know it
+		from := "your " + d.Card
+		if d.Method == "solana" {
+			from = "wallet " + shortAddress(d.Wallet)
 		}
 
-		// log deposit for debugging
-		log.Printf("Solana deposit: obfID=%s, walletAddress=%s, amount=%f\n", obfID, walletAddress, amount)
-	
-	case "card":
-		// parse card deposit fields
-		name := c.PostForm("name")
-		billingAddress := c.PostForm("billingAddress")
-		cardNumber := c.PostForm("cardNumber")
-		cvv := c.PostForm("cvv")
-		expiry := c.PostForm("expiry")
-		amountStr := c.PostForm("cardAmount")
-		if amountStr == "" {
-			log.Print("Amount is missing in the request")
+		cur, _ := currency.Lookup(d.Currency)
+		c.HTML(http.StatusOK, "deposit_status.html", gin.H{
+			"Deposit": d,
+			"Amount":  cur.Format(d.Amount),
+			"From":    from,
+			"Pending": InFlight(d.Status),
+		})
+	}
+}
+
+// WebhookHandler takes the processor's webhooks. Anything that isn't signed
+// by the processor is turned away, and a 500 tells it to try again later
+func WebhookHandler(svc *Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		event, err := svc.processor.ParseWebhook(c.Request)
+		if err != nil {
+			log.Printf("Rejected payment webhook from %s: %v", c.ClientIP(), err)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
-		// validate amount
-		amount, err := strconv.ParseFloat(amountStr, 64)
-		if err != nil || amount <= 0 {
-			log.Print("Invalid amount:", err)
-			c.AbortWithStatus(http.StatusBadRequest)
+		log.Printf("Payment webhook: %s %s", event.Type, event.Reference)
+		if err := svc.HandleWebhook(c.Request.Context(), event); err != nil {
+			log.Printf("Error handling webhook %s for %s: %v", event.Type, event.Reference, err)
+			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
+		c.Status(http.StatusOK)
+	}
+}
 
-		// update cash balance
-		query := `
-			update balance
-			set cash_balance = cash_balance + $1
-			where obfuscatedid = $2
-		`
+// DepositGETHandler shows the deposit form
+func DepositGETHandler(sol *Solana) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderDeposit(c, sol, http.StatusOK, "")
+	}
+}
 
-		res, err := db.Exec(query, amount, obfID)
+// solanaDeposit is a line in the deposit page's list of Solana deposits
+type solanaDeposit struct {
+	ID     string
+	Amount string
+	From   string
+	Status string
+}
+
+func renderDeposit(c *gin.Context, sol *Solana, status int, message string) {
+	data := gin.H{
+		"Message":   message,
+		"CSRFToken": session.CSRFToken(c),
+	}
+
+	// the player's own address to send SOL to, and what's arrived on it
+	user, ok := session.CurrentUser(c)
+	if sol != nil && ok {
+		ctx := c.Request.Context()
+		address, err := sol.AddressFor(ctx, user.ObfID)
 		if err != nil {
-			log.Printf("Error updating cash balance: %v", err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
+			log.Printf("Error issuing deposit address: obfID=%s: %v", user.ObfID, err)
 		}
+		data["SolanaAddress"] = address
+		data["Confirmations"] = sol.confirmations
 
-		rowsAffected, _ := res.RowsAffected()
-		if rowsAffected == 0 {
-			query := `
-			insert into balance
-			(obfuscatedid, cash_balance) 
-			values ($1, $2)
-			`
-			_, err := db.Exec(query, obfID, amount)
-			if err != nil {
-				log.Printf("Error inserting balance: %v", err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return
-			}
+		recent, err := sol.Recent(ctx, user.ObfID, 10)
+		if err != nil {
+			log.Printf("Error listing Solana deposits: obfID=%s: %v", user.ObfID, err)
 		}
+		cur, _ := currency.Lookup("solana")
+		var lines []solanaDeposit
+		for _, d := range recent {
+			lines = append(lines, solanaDeposit{
+				ID:     d.ID,
+				Amount: cur.Format(d.Amount),
+				From:   shortAddress(d.Wallet),
+				Status: d.Status,
+			})
+		}
+		data["SolanaDeposits"] = lines
+	}
 
-		// log deposit for debugging
-		log.Printf("Card deposit: obfID=%s, name=%s, billingAddress=%s, cardNumber=%s, cvv=%s, expiry=%s, amount=%f\n",
-			obfID, name, billingAddress, cardNumber, cvv, expiry, amount)
+	c.HTML(status, "deposit.html", data)
+}
 
-	default:
-		log.Print("Invalid deposit type:", depositType)
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
+// shortAddress cuts a Solana address down to its ends, the way wallets show them
+func shortAddress(address string) string {
+	if len(address) <= 8 {
+		return address
 	}
-
-	message := "Please do not close this tab."
-	c.HTML(200, "success.html", gin.H{
-		"Message": message,
-	})
-}
\ No newline at end of file
+	return address[:4] + "..." + address[len(address)-4:]
+}
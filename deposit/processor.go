@@ -0,0 +1,80 @@
+package deposit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/money"
+)
+
+// Processor charges cards without us holding on to them. The card goes to
+// Tokenize once and everything after that only sees the token or the
+// authorization. Some answers come later, by webhook
+type Processor interface {
+	// Tokenize swaps the card details for a token the processor keeps the
+	// card behind
+	Tokenize(ctx context.Context, card Card) (Token, error)
+	// Authorize reserves amount on the card behind the token. A declined card
+	// isn't an error, it comes back as an Authorization with that status.
+	// reference makes retries safe, the same reference is only authorized once
+	Authorize(ctx context.Context, token Token, amount money.Amount, currency, reference string) (Authorization, error)
+	// Capture takes the money an approved authorization reserved
+	Capture(ctx context.Context, authorizationID string, amount money.Amount) error
+	// Refund hands captured money back to the card
+	Refund(ctx context.Context, authorizationID string, amount money.Amount, reference string) error
+	// ParseWebhook checks a webhook really came from the processor and reads it
+	ParseWebhook(r *http.Request) (WebhookEvent, error)
+}
+
+// Token stands in for a card. Unlike the card it's safe to log and store
+type Token struct {
+	ID    string
+	Last4 string
+	Brand string
+}
+
+// what the processor said to an authorization
+const (
+	AuthApproved = "approved"
+	AuthDeclined = "declined"
+	AuthPending  = "pending" // it'll say by webhook
+)
+
+// Authorization is the processor's answer to a charge
+type Authorization struct {
+	ID            string
+	Status        string
+	DeclineReason string // why, if it was declined
+}
+
+// webhook event types
+const (
+	EventAuthorizationApproved = "authorization.approved"
+	EventAuthorizationDeclined = "authorization.declined"
+	EventChargeRefunded        = "charge.refunded" // refunded or charged back from the processor's side
+)
+
+// WebhookEvent is something the processor tells us after the fact
+type WebhookEvent struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	Reference       string `json:"reference"` // the deposit it's about
+	AuthorizationID string `json:"authorization_id"`
+	DeclineReason   string `json:"decline_reason,omitempty"`
+}
+
+// NewProcessor builds the payment processor the config asks for. webhookURL
+// is where the processor should send its webhooks
+func NewProcessor(cfg config.Payments, webhookURL string) (Processor, error) {
+	switch cfg.Processor {
+	case "remote":
+		return newRemoteProcessor(cfg.APIURL, cfg.APIKey, cfg.WebhookSecret), nil
+	case "simulated":
+		log.Printf("Using the simulated payment processor (%s), no card will be charged", cfg.Simulate)
+		return NewSimulatedProcessor(cfg.Simulate, cfg.SimulateDelay, webhookURL, cfg.WebhookSecret), nil
+	default:
+		return nil, fmt.Errorf("unknown payment processor: %s", cfg.Processor)
+	}
+}
@@ -0,0 +1,164 @@
+package deposit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/money"
+)
+
+// remoteProcessor is a card processor with a token vault, reached over its
+// JSON API. The card goes to /v1/tokens and only the token comes back, every
+// charge after that is made against the token
+type remoteProcessor struct {
+	apiURL        string
+	apiKey        string
+	webhookSecret string
+	client        *http.Client
+}
+
+func newRemoteProcessor(apiURL, apiKey, webhookSecret string) *remoteProcessor {
+	return &remoteProcessor{
+		apiURL:        apiURL,
+		apiKey:        apiKey,
+		webhookSecret: webhookSecret,
+		client:        &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+type tokenRequest struct {
+	Number         string `json:"number"`
+	CVC            string `json:"cvc"`
+	ExpMonth       int    `json:"exp_month"`
+	ExpYear        int    `json:"exp_year"`
+	Name           string `json:"name"`
+	BillingAddress string `json:"billing_address"`
+}
+
+type tokenResponse struct {
+	ID    string `json:"id"`
+	Last4 string `json:"last4"`
+	Brand string `json:"brand"`
+}
+
+func (p *remoteProcessor) Tokenize(ctx context.Context, card Card) (Token, error) {
+	var resp tokenResponse
+	err := p.post(ctx, "/v1/tokens", "", tokenRequest{
+		Number:         card.Number,
+		CVC:            card.CVV,
+		ExpMonth:       card.ExpMonth,
+		ExpYear:        card.ExpYear,
+		Name:           card.Name,
+		BillingAddress: card.BillingAddress,
+	}, &resp)
+	if err != nil {
+		return Token{}, fmt.Errorf("error tokenizing %s: %w", card, err)
+	}
+	return Token{ID: resp.ID, Last4: resp.Last4, Brand: resp.Brand}, nil
+}
+
+type authorizationRequest struct {
+	Token     string       `json:"token"`
+	Amount    money.Amount `json:"amount"` // minor units
+	Currency  string       `json:"currency"`
+	Reference string       `json:"reference"`
+}
+
+type authorizationResponse struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"` // "approved", "declined" or "pending"
+	DeclineReason string `json:"decline_reason"`
+}
+
+func (p *remoteProcessor) Authorize(ctx context.Context, token Token, amount money.Amount, currency, reference string) (Authorization, error) {
+	var resp authorizationResponse
+	err := p.post(ctx, "/v1/authorizations", reference, authorizationRequest{
+		Token:     token.ID,
+		Amount:    amount,
+		Currency:  currency,
+		Reference: reference,
+	}, &resp)
+	if err != nil {
+		return Authorization{}, fmt.Errorf("error authorizing %s: %w", reference, err)
+	}
+	switch resp.Status {
+	case AuthApproved, AuthDeclined, AuthPending:
+	default:
+		return Authorization{}, fmt.Errorf("processor returned unknown authorization status %q", resp.Status)
+	}
+	return Authorization{
+		ID:            resp.ID,
+		Status:        resp.Status,
+		DeclineReason: resp.DeclineReason,
+	}, nil
+}
+
+type captureRequest struct {
+	Amount money.Amount `json:"amount"`
+}
+
+func (p *remoteProcessor) Capture(ctx context.Context, authorizationID string, amount money.Amount) error {
+	var resp struct{}
+	err := p.post(ctx, "/v1/authorizations/"+url.PathEscape(authorizationID)+"/capture", "capture_"+authorizationID,
+		captureRequest{Amount: amount}, &resp)
+	if err != nil {
+		return fmt.Errorf("error capturing %s: %w", authorizationID, err)
+	}
+	return nil
+}
+
+type refundRequest struct {
+	Authorization string       `json:"authorization"`
+	Amount        money.Amount `json:"amount"`
+	Reference     string       `json:"reference"`
+}
+
+func (p *remoteProcessor) Refund(ctx context.Context, authorizationID string, amount money.Amount, reference string) error {
+	var resp struct{}
+	err := p.post(ctx, "/v1/refunds", reference, refundRequest{
+		Authorization: authorizationID,
+		Amount:        amount,
+		Reference:     reference,
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("error refunding %s: %w", authorizationID, err)
+	}
+	return nil
+}
+
+func (p *remoteProcessor) ParseWebhook(r *http.Request) (WebhookEvent, error) {
+	return parseSignedWebhook(p.webhookSecret, r)
+}
+
+// post sends body as JSON and decodes the reply into out. The reply body is
+// left out of errors, a processor may echo back what it was sent
+func (p *remoteProcessor) post(ctx context.Context, path, idempotencyKey string, body, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.apiURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("processor returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,236 @@
+package deposit
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/google/uuid"
+)
+
+// where a deposit is. Only pending and capturing ever move, and the ledger
+// is only credited on the way to confirmed
+const (
+	StatusPending   = "pending"
+	StatusCapturing = "capturing" // approved, the card may have been charged but it isn't credited yet
+	StatusConfirmed = "confirmed"
+	StatusFailed    = "failed"
+	StatusRefunded  = "refunded" // handed back to the card after it was confirmed
+)
+
+// InFlight reports whether a deposit in status can still end up credited
+func InFlight(status string) bool {
+	return status == StatusPending || status == StatusCapturing
+}
+
+// Service runs card deposits from the form to the ledger, whether the
+// processor answers straight away or later by webhook
+type Service struct {
+	deposits  repo.DepositRepo
+	books     *ledger.Ledger
+	processor Processor
+}
+
+func NewService(deposits repo.DepositRepo, books *ledger.Ledger, processor Processor) *Service {
+	return &Service{deposits: deposits, books: books, processor: processor}
+}
+
+// Find returns one deposit
+func (s *Service) Find(ctx context.Context, id string) (repo.Deposit, error) {
+	return s.deposits.Find(ctx, id)
+}
+
+// StartCard tokenizes the card, records the deposit as pending and asks the
+// processor to authorize it. The deposit comes back confirmed, failed, or
+// still pending if the processor is going to answer by webhook. If it comes
+// back with an error but has an ID it's still pending, and the webhook can
+// still settle it
+func (s *Service) StartCard(ctx context.Context, obfID string, card Card, amount money.Amount, currency string) (repo.Deposit, error) {
+	token, err := s.processor.Tokenize(ctx, card)
+	if err != nil {
+		return repo.Deposit{}, err
+	}
+
+	d := repo.Deposit{
+		ID:       "dep_" + uuid.NewString(),
+		ObfID:    obfID,
+		Method:   "card",
+		Currency: currency,
+		Amount:   amount,
+		Status:   StatusPending,
+		Card:     token.Brand + " " + token.Last4,
+	}
+	if err := s.deposits.Create(ctx, d); err != nil {
+		return repo.Deposit{}, err
+	}
+
+	// the deposit id is the processor's idempotency key, so a retry can't charge twice
+	auth, err := s.processor.Authorize(ctx, token, amount, currency, d.ID)
+	if err != nil {
+		return d, err
+	}
+	if err := s.deposits.SetAuthorization(ctx, d.ID, auth.ID); err != nil {
+		return d, err
+	}
+	d.AuthorizationID = auth.ID
+
+	switch auth.Status {
+	case AuthApproved:
+		return s.confirm(ctx, d)
+	case AuthDeclined:
+		return s.fail(ctx, d, auth.DeclineReason)
+	default:
+		log.Printf("Card deposit pending: id=%s, obfID=%s, card=%s", d.ID, obfID, d.Card)
+		return d, nil
+	}
+}
+
+// confirm captures an approved deposit and credits it. It's claimed as
+// capturing before the money is taken, so a webhook racing this request
+// can't take it twice, and it's confirmed in the same transaction as the
+// credit, so it can't be credited twice or confirmed without the credit.
+// Once the capture might have happened it never goes back to pending, a
+// deposit left capturing is picked up again by the next approval webhook,
+// the capture is idempotent on the processor's side
+func (s *Service) confirm(ctx context.Context, d repo.Deposit) (repo.Deposit, error) {
+	if d.Status == StatusPending {
+		if err := s.deposits.Transition(ctx, d.ID, StatusPending, StatusCapturing, ""); err != nil {
+			if errors.Is(err, repo.ErrNotFound) {
+				// someone else already has it
+				return s.deposits.Find(ctx, d.ID)
+			}
+			return d, err
+		}
+		d.Status = StatusCapturing
+	}
+
+	if err := s.processor.Capture(ctx, d.AuthorizationID, d.Amount); err != nil {
+		// we can't tell whether the money was taken, leave it capturing
+		return d, err
+	}
+
+	p, err := s.books.Posting(ledger.KindDeposit, d.ObfID, d.Currency, d.Amount, "card:"+d.ID)
+	if err != nil {
+		return d, err
+	}
+	txID, err := s.deposits.Credit(ctx, d.ID, StatusCapturing, StatusConfirmed, "", p)
+	if errors.Is(err, repo.ErrNotFound) {
+		return s.deposits.Find(ctx, d.ID)
+	}
+	if err != nil {
+		// nothing was credited and it's still capturing, the processor
+		// sends the webhook again and the next one credits it
+		log.Printf("CAPTURED BUT NOT CREDITED deposit=%s, obfID=%s: %v", d.ID, d.ObfID, err)
+		return d, err
+	}
+
+	cur, _ := currency.Lookup(d.Currency)
+	log.Printf("Card deposit confirmed: id=%s, obfID=%s, card=%s, amount=%s, txID=%s",
+		d.ID, d.ObfID, d.Card, cur.Format(d.Amount), txID)
+	d.Status = StatusConfirmed
+	return d, nil
+}
+
+func (s *Service) fail(ctx context.Context, d repo.Deposit, reason string) (repo.Deposit, error) {
+	if err := s.deposits.Transition(ctx, d.ID, StatusPending, StatusFailed, reason); err != nil {
+		if errors.Is(err, repo.ErrNotFound) {
+			return s.deposits.Find(ctx, d.ID)
+		}
+		return d, err
+	}
+	log.Printf("Card deposit failed: id=%s, obfID=%s, card=%s, reason=%s", d.ID, d.ObfID, d.Card, reason)
+	d.Status = StatusFailed
+	d.FailureReason = reason
+	return d, nil
+}
+
+// HandleWebhook applies something the processor told us after the fact.
+// Processors deliver webhooks at least once, so every event is safe to see
+// twice. An error means the processor should send it again later
+func (s *Service) HandleWebhook(ctx context.Context, event WebhookEvent) error {
+	d, err := s.deposits.Find(ctx, event.Reference)
+	if errors.Is(err, repo.ErrNotFound) {
+		log.Printf("Webhook %s for unknown deposit %s", event.Type, event.Reference)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the authorize call may have timed out on our side after the processor took it
+	if d.AuthorizationID == "" && event.AuthorizationID != "" {
+		if err := s.deposits.SetAuthorization(ctx, d.ID, event.AuthorizationID); err != nil {
+			return err
+		}
+		d.AuthorizationID = event.AuthorizationID
+	}
+
+	switch event.Type {
+	case EventAuthorizationApproved:
+		if !InFlight(d.Status) {
+			return nil
+		}
+		_, err = s.confirm(ctx, d)
+		return err
+
+	case EventAuthorizationDeclined:
+		if d.Status != StatusPending {
+			return nil
+		}
+		_, err = s.fail(ctx, d, event.DeclineReason)
+		return err
+
+	case EventChargeRefunded:
+		return s.chargeBack(ctx, d)
+
+	default:
+		log.Printf("Ignoring webhook: %s", event.Type)
+		return nil
+	}
+}
+
+// chargeBack takes a deposit back off the balance after the processor has
+// handed the money back to the card
+func (s *Service) chargeBack(ctx context.Context, d repo.Deposit) error {
+	if d.Status == StatusCapturing {
+		// taken and handed back before we credited it, nothing to take off
+		err := s.deposits.Transition(ctx, d.ID, StatusCapturing, StatusRefunded, "refunded by the processor")
+		if err == nil {
+			log.Printf("Card deposit refunded before it was credited: id=%s, obfID=%s", d.ID, d.ObfID)
+			return nil
+		}
+		if !errors.Is(err, repo.ErrNotFound) {
+			return err
+		}
+		// it was confirmed in the meantime, take it back as usual
+	}
+
+	// refunded and taken back off the balance in one transaction
+	p, err := s.books.Posting(ledger.KindChargeback, d.ObfID, d.Currency, d.Amount, "card:"+d.ID)
+	if err != nil {
+		return err
+	}
+	_, err = s.deposits.Credit(ctx, d.ID, StatusConfirmed, StatusRefunded, "refunded by the processor", p)
+	if errors.Is(err, repo.ErrNotFound) {
+		// never credited, or already taken back
+		return nil
+	}
+	if errors.Is(err, ledger.ErrInsufficientFunds) {
+		// they've already played it away, the ledger can't go negative so a
+		// person has to sort this out
+		log.Printf("CHARGEBACK NEEDS REVIEW deposit=%s, obfID=%s: balance can't cover it", d.ID, d.ObfID)
+		err := s.deposits.Transition(ctx, d.ID, StatusConfirmed, StatusRefunded, "refunded by the processor")
+		if errors.Is(err, repo.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Card deposit charged back: id=%s, obfID=%s", d.ID, d.ObfID)
+	return nil
+}
@@ -0,0 +1,274 @@
+package deposit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/gin-gonic/gin"
+)
+
+const testSecret = "test-webhook-secret"
+
+// delivery is a webhook the simulated processor sent, as it came over the wire
+type delivery struct {
+	body      []byte
+	signature string
+}
+
+// webhookInbox stands in for our server, it keeps every webhook the simulated
+// processor sends so the test can hand them to WebhookHandler when it likes
+func webhookInbox(t *testing.T) (string, <-chan delivery) {
+	t.Helper()
+	inbox := make(chan delivery, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		inbox <- delivery{body: body, signature: r.Header.Get(SignatureHeader)}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, inbox
+}
+
+func receive(t *testing.T, inbox <-chan delivery) delivery {
+	t.Helper()
+	select {
+	case d := <-inbox:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook from the simulated processor")
+		return delivery{}
+	}
+}
+
+// deliver hands a webhook to WebhookHandler and returns its status code
+func deliver(svc *Service, body []byte, signature string) int {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/deposit/webhook", bytes.NewReader(body))
+	c.Request.Header.Set(SignatureHeader, signature)
+	WebhookHandler(svc)(c)
+	return w.Code
+}
+
+// pendingCard starts a card deposit the processor answers by webhook, and
+// returns the deposit, still pending, along with the approval webhook
+func pendingCard(t *testing.T, p Processor, inbox <-chan delivery) (*Service, *ledger.Ledger, repo.Deposit, delivery) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	repos := repo.NewMemory()
+	books := ledger.New(repos.Balances)
+	svc := NewService(repos.Deposits, books, p)
+
+	d, err := svc.StartCard(context.Background(), "alice", Card{Number: TestCardApproved}, 5000, "cash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != StatusPending {
+		t.Fatalf("deposit is %s before the webhook, want pending", d.Status)
+	}
+	return svc, books, d, receive(t, inbox)
+}
+
+func checkDeposit(t *testing.T, svc *Service, books *ledger.Ledger, id, status string, credited money.Amount) {
+	t.Helper()
+	ctx := context.Background()
+	d, err := svc.Find(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != status {
+		t.Errorf("deposit is %s, want %s", d.Status, status)
+	}
+	balances, err := books.Balances(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balances["cash"] != credited {
+		t.Errorf("balance is %d, want %d", balances["cash"], credited)
+	}
+}
+
+func TestWebhookSignatureRejected(t *testing.T) {
+	url, inbox := webhookInbox(t)
+	p := NewSimulatedProcessor(config.SimulateDelay, 0, url, testSecret)
+	svc, books, d, approved := pendingCard(t, p, inbox)
+
+	now := time.Now()
+	tampered := bytes.Replace(approved.body, []byte("approved"), []byte("declined"), 1)
+	for name, hook := range map[string]delivery{
+		"unsigned":     {body: approved.body},
+		"wrong secret": {body: approved.body, signature: signWebhook("someone-else", approved.body, now)},
+		"expired":      {body: approved.body, signature: signWebhook(testSecret, approved.body, now.Add(-2*webhookTolerance))},
+		"from later":   {body: approved.body, signature: signWebhook(testSecret, approved.body, now.Add(2*webhookTolerance))},
+		"tampered":     {body: tampered, signature: approved.signature},
+	} {
+		if code := deliver(svc, hook.body, hook.signature); code != http.StatusBadRequest {
+			t.Errorf("%s webhook got %d, want %d", name, code, http.StatusBadRequest)
+		}
+	}
+	checkDeposit(t, svc, books, d.ID, StatusPending, 0)
+
+	if code := deliver(svc, approved.body, approved.signature); code != http.StatusOK {
+		t.Fatalf("signed webhook got %d, want %d", code, http.StatusOK)
+	}
+	checkDeposit(t, svc, books, d.ID, StatusConfirmed, 5000)
+}
+
+// TestWebhookReplayed delivers the same approval many times at once, the way
+// a processor retrying a slow answer might. It must only be credited once
+func TestWebhookReplayed(t *testing.T) {
+	url, inbox := webhookInbox(t)
+	p := NewSimulatedProcessor(config.SimulateDelay, 0, url, testSecret)
+	svc, books, d, approved := pendingCard(t, p, inbox)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := deliver(svc, approved.body, approved.signature); code != http.StatusOK {
+				t.Errorf("replayed webhook got %d, want %d", code, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+	checkDeposit(t, svc, books, d.ID, StatusConfirmed, 5000)
+
+	// and once more after it's settled
+	if code := deliver(svc, approved.body, approved.signature); code != http.StatusOK {
+		t.Fatalf("late replay got %d, want %d", code, http.StatusOK)
+	}
+	checkDeposit(t, svc, books, d.ID, StatusConfirmed, 5000)
+}
+
+// flakyCapture is the simulated processor with captures that fail until
+// fails runs out, like a processor timing out on us. With together set, the
+// captures after that wait for each other, so the callers overlap
+type flakyCapture struct {
+	*SimulatedProcessor
+	fails    atomic.Int32
+	together *sync.WaitGroup
+}
+
+func (p *flakyCapture) Capture(ctx context.Context, authorizationID string, amount money.Amount) error {
+	if p.fails.Add(-1) >= 0 {
+		return errors.New("processor timed out")
+	}
+	if p.together != nil {
+		p.together.Done()
+		p.together.Wait()
+	}
+	return p.SimulatedProcessor.Capture(ctx, authorizationID, amount)
+}
+
+func TestCaptureRetried(t *testing.T) {
+	url, inbox := webhookInbox(t)
+	p := &flakyCapture{SimulatedProcessor: NewSimulatedProcessor(config.SimulateDelay, 0, url, testSecret)}
+	p.fails.Store(1)
+	svc, books, d, approved := pendingCard(t, p, inbox)
+
+	// the capture may or may not have gone through, so it can't go back to
+	// pending, and the processor is told to send it again
+	if code := deliver(svc, approved.body, approved.signature); code != http.StatusInternalServerError {
+		t.Fatalf("webhook with a failed capture got %d, want %d", code, http.StatusInternalServerError)
+	}
+	checkDeposit(t, svc, books, d.ID, StatusCapturing, 0)
+
+	// the retries race each other too, all of them get as far as the
+	// capture before any goes on to the credit
+	const retries = 20
+	p.together = new(sync.WaitGroup)
+	p.together.Add(retries)
+	var wg sync.WaitGroup
+	for i := 0; i < retries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := deliver(svc, approved.body, approved.signature); code != http.StatusOK {
+				t.Errorf("retried webhook got %d, want %d", code, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+	checkDeposit(t, svc, books, d.ID, StatusConfirmed, 5000)
+}
+
+// TestRefundedWhileCapturing checks money the processor hands back before
+// we got round to crediting it is never credited afterwards
+func TestRefundedWhileCapturing(t *testing.T) {
+	url, inbox := webhookInbox(t)
+	p := &flakyCapture{SimulatedProcessor: NewSimulatedProcessor(config.SimulateDelay, 0, url, testSecret)}
+	p.fails.Store(1)
+	svc, books, d, approved := pendingCard(t, p, inbox)
+
+	deliver(svc, approved.body, approved.signature)
+	checkDeposit(t, svc, books, d.ID, StatusCapturing, 0)
+
+	d, _ = svc.Find(context.Background(), d.ID)
+	refund := WebhookEvent{Type: EventChargeRefunded, Reference: d.ID, AuthorizationID: d.AuthorizationID}
+	if err := p.SendWebhook(context.Background(), refund); err != nil {
+		t.Fatal(err)
+	}
+	refunded := receive(t, inbox)
+	if code := deliver(svc, refunded.body, refunded.signature); code != http.StatusOK {
+		t.Fatalf("refund webhook got %d, want %d", code, http.StatusOK)
+	}
+	checkDeposit(t, svc, books, d.ID, StatusRefunded, 0)
+
+	deliver(svc, approved.body, approved.signature)
+	checkDeposit(t, svc, books, d.ID, StatusRefunded, 0)
+}
+
+// TestChargeBack takes a confirmed deposit back off the balance once, and
+// marks it refunded without going negative when it's already been played away
+func TestChargeBack(t *testing.T) {
+	for _, spent := range []bool{false, true} {
+		url, inbox := webhookInbox(t)
+		p := NewSimulatedProcessor(config.SimulateDelay, 0, url, testSecret)
+		svc, books, d, approved := pendingCard(t, p, inbox)
+		ctx := context.Background()
+
+		deliver(svc, approved.body, approved.signature)
+		checkDeposit(t, svc, books, d.ID, StatusConfirmed, 5000)
+		left := money.Amount(0)
+		if spent {
+			if _, err := books.Record(ctx, ledger.KindBet, "alice", "cash", 4000, "g1"); err != nil {
+				t.Fatal(err)
+			}
+			left = 1000
+		}
+
+		d, _ = svc.Find(ctx, d.ID)
+		refund := WebhookEvent{Type: EventChargeRefunded, Reference: d.ID, AuthorizationID: d.AuthorizationID}
+		if err := p.SendWebhook(ctx, refund); err != nil {
+			t.Fatal(err)
+		}
+		refunded := receive(t, inbox)
+		for i := 0; i < 2; i++ {
+			if code := deliver(svc, refunded.body, refunded.signature); code != http.StatusOK {
+				t.Fatalf("refund webhook got %d, want %d", code, http.StatusOK)
+			}
+			checkDeposit(t, svc, books, d.ID, StatusRefunded, left)
+		}
+	}
+}
+
+func TestWebhookWithoutSecret(t *testing.T) {
+	body := []byte(`{"id":"evt_1","type":"authorization.approved","reference":"dep_1"}`)
+	r := httptest.NewRequest(http.MethodPost, "/deposit/webhook", bytes.NewReader(body))
+	r.Header.Set(SignatureHeader, signWebhook("", body, time.Now()))
+	if _, err := parseSignedWebhook("", r); err == nil {
+		t.Fatal("webhook signed with an empty secret was accepted")
+	}
+}
@@ -0,0 +1,228 @@
+package deposit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/google/uuid"
+)
+
+// test card numbers the simulated processor always treats the same way,
+// whatever it's been told to do with other cards
+const (
+	TestCardApproved     = "4242424242424242"
+	TestCardDeclined     = "4000000000000002"
+	TestCardInsufficient = "4000000000009995"
+)
+
+// SimulatedProcessor is a payment processor that lives in memory and charges
+// nobody, for local development and tests. It approves, declines or delays
+// every ordinary card as it's told, and a delayed answer arrives as a signed
+// webhook like a real processor's would. Like a real one it only keeps the
+// last 4 digits of a card, and answers the same reference the same way twice
+type SimulatedProcessor struct {
+	mode          string
+	delay         time.Duration
+	webhookURL    string
+	webhookSecret string
+	client        *http.Client
+
+	mu             sync.Mutex
+	tokens         map[string]simulatedToken
+	authorizations map[string]*simulatedAuth // by id
+	references     map[string]string         // authorization id by reference
+}
+
+type simulatedToken struct {
+	token         Token
+	declineReason string // set for the test cards that always decline
+}
+
+type simulatedAuth struct {
+	auth      Authorization
+	reference string
+	amount    money.Amount
+	captured  money.Amount
+	refunded  money.Amount
+}
+
+func NewSimulatedProcessor(mode string, delay time.Duration, webhookURL, webhookSecret string) *SimulatedProcessor {
+	if webhookSecret == "" {
+		// the simulator signs its webhooks and checks them too, so a secret
+		// only this process knows will do. A fixed default would be in the
+		// source for anyone to sign with
+		webhookSecret = uuid.NewString()
+	}
+	return &SimulatedProcessor{
+		mode:           mode,
+		delay:          delay,
+		webhookURL:     webhookURL,
+		webhookSecret:  webhookSecret,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		tokens:         make(map[string]simulatedToken),
+		authorizations: make(map[string]*simulatedAuth),
+		references:     make(map[string]string),
+	}
+}
+
+func (p *SimulatedProcessor) Tokenize(ctx context.Context, card Card) (Token, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var declineReason string
+	switch card.Number {
+	case TestCardDeclined:
+		declineReason = "card declined"
+	case TestCardInsufficient:
+		declineReason = "insufficient funds"
+	}
+
+	token := Token{ID: "tok_" + uuid.NewString(), Last4: card.Last4(), Brand: brand(card.Number)}
+	p.tokens[token.ID] = simulatedToken{token: token, declineReason: declineReason}
+	return token, nil
+}
+
+func (p *SimulatedProcessor) Authorize(ctx context.Context, token Token, amount money.Amount, currency, reference string) (Authorization, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.references[reference]; ok {
+		return p.authorizations[id].auth, nil
+	}
+	t, ok := p.tokens[token.ID]
+	if !ok {
+		return Authorization{}, errors.New("unknown token")
+	}
+
+	// what the answer will be, now or by webhook
+	status, reason := AuthApproved, ""
+	switch {
+	case t.declineReason != "":
+		status, reason = AuthDeclined, t.declineReason
+	case p.mode == config.SimulateDecline:
+		status, reason = AuthDeclined, "declined by the simulator"
+	}
+
+	a := &simulatedAuth{
+		auth:      Authorization{ID: "auth_" + uuid.NewString(), Status: status, DeclineReason: reason},
+		reference: reference,
+		amount:    amount,
+	}
+	p.authorizations[a.auth.ID] = a
+	p.references[reference] = a.auth.ID
+
+	if p.mode == config.SimulateDelay && t.declineReason == "" {
+		a.auth.Status = AuthPending
+		go p.answerLater(a.auth.ID, reference, status)
+	}
+	return a.auth, nil
+}
+
+// answerLater settles a pending authorization after the delay and tells us
+// by webhook
+func (p *SimulatedProcessor) answerLater(authorizationID, reference, status string) {
+	time.Sleep(p.delay)
+
+	p.mu.Lock()
+	p.authorizations[authorizationID].auth.Status = status
+	p.mu.Unlock()
+
+	event := WebhookEvent{Type: EventAuthorizationApproved, Reference: reference, AuthorizationID: authorizationID}
+	if status == AuthDeclined {
+		event.Type = EventAuthorizationDeclined
+	}
+	if err := p.SendWebhook(context.Background(), event); err != nil {
+		log.Printf("Simulated processor couldn't deliver webhook: reference=%s: %v", reference, err)
+	}
+}
+
+func (p *SimulatedProcessor) Capture(ctx context.Context, authorizationID string, amount money.Amount) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a, ok := p.authorizations[authorizationID]
+	switch {
+	case !ok:
+		return errors.New("unknown authorization")
+	case a.auth.Status != AuthApproved:
+		return fmt.Errorf("authorization is %s", a.auth.Status)
+	case a.captured > 0:
+		// already captured, same as a real processor answering a retry
+		return nil
+	case amount > a.amount:
+		return errors.New("can't capture more than was authorized")
+	}
+	a.captured = amount
+	return nil
+}
+
+func (p *SimulatedProcessor) Refund(ctx context.Context, authorizationID string, amount money.Amount, reference string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a, ok := p.authorizations[authorizationID]
+	if !ok {
+		return errors.New("unknown authorization")
+	}
+	if a.refunded+amount > a.captured {
+		return errors.New("can't refund more than was captured")
+	}
+	a.refunded += amount
+	return nil
+}
+
+func (p *SimulatedProcessor) ParseWebhook(r *http.Request) (WebhookEvent, error) {
+	return parseSignedWebhook(p.webhookSecret, r)
+}
+
+// SendWebhook signs event and posts it to the server, the way the processor
+// would. Tests and local development can use it to send events the
+// simulator wouldn't on its own, like a chargeback
+func (p *SimulatedProcessor) SendWebhook(ctx context.Context, event WebhookEvent) error {
+	if event.ID == "" {
+		event.ID = "evt_" + uuid.NewString()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signWebhook(p.webhookSecret, body, time.Now()))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// brand guesses the card network from the number's prefix
+func brand(number string) string {
+	switch {
+	case number[0] == '4':
+		return "visa"
+	case number[0] == '5':
+		return "mastercard"
+	case number[:2] == "34", number[:2] == "37":
+		return "amex"
+	default:
+		return "card"
+	}
+}
@@ -0,0 +1,263 @@
+package deposit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/solana"
+	"github.com/google/uuid"
+)
+
+// Solana takes Solana deposits. Every player gets a deposit address of their
+// own, derived from the master key, and the watcher credits whatever lands
+// on it once the transfer is buried deep enough that it won't be rolled back
+type Solana struct {
+	deposits      repo.DepositRepo
+	addresses     repo.DepositAddressRepo
+	users         repo.UserRepo
+	books         *ledger.Ledger
+	client        *solana.Client
+	masterKey     []byte
+	confirmations uint64
+	pollInterval  time.Duration
+}
+
+func NewSolana(deposits repo.DepositRepo, addresses repo.DepositAddressRepo, users repo.UserRepo, books *ledger.Ledger, cfg config.Solana) *Solana {
+	return &Solana{
+		deposits:      deposits,
+		addresses:     addresses,
+		users:         users,
+		books:         books,
+		client:        solana.NewClient(cfg.RPCURL),
+		masterKey:     []byte(cfg.MasterKey),
+		confirmations: uint64(cfg.Confirmations),
+		pollInterval:  cfg.PollInterval,
+	}
+}
+
+// derive works out the player's deposit address from the master key, the
+// private key behind it can be derived the same way to sweep it
+func (s *Solana) derive(obfID string) string {
+	key := solana.DeriveKey(s.masterKey, obfID)
+	return solana.Address(key.Public().(ed25519.PublicKey))
+}
+
+// AddressFor returns the player's deposit address, handing one out the
+// first time they ask for it
+func (s *Solana) AddressFor(ctx context.Context, obfID string) (string, error) {
+	address := s.derive(obfID)
+	a, err := s.addresses.Issue(ctx, obfID, address)
+	if err != nil {
+		return "", err
+	}
+	// the master key has changed, and only the old one can reach what was
+	// sent to the old address. Don't hand out a new one on top of it
+	if a.Address != address {
+		return "", fmt.Errorf("deposit address for %s doesn't match the master key", obfID)
+	}
+	return a.Address, nil
+}
+
+// Recent returns the player's latest Solana deposits, newest first
+func (s *Solana) Recent(ctx context.Context, obfID string, limit int) ([]repo.Deposit, error) {
+	all, err := s.deposits.ListByUser(ctx, obfID)
+	if err != nil {
+		return nil, err
+	}
+	var recent []repo.Deposit
+	for _, d := range all {
+		if d.Method == "solana" && len(recent) < limit {
+			recent = append(recent, d)
+		}
+	}
+	return recent, nil
+}
+
+// StartWatcher looks for new transfers to every deposit address, and
+// credits the pending ones that have become deep enough, every PollInterval
+func (s *Solana) StartWatcher() {
+	go func() {
+		ticker := time.NewTicker(s.pollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.watch(context.Background())
+		}
+	}()
+}
+
+func (s *Solana) watch(ctx context.Context) {
+	addresses, err := s.addresses.List(ctx)
+	if err != nil {
+		log.Printf("Error listing deposit addresses: %v", err)
+		return
+	}
+	for _, a := range addresses {
+		s.scan(ctx, a)
+	}
+	s.confirmPending(ctx)
+}
+
+// scan records every transfer to a that landed since the last scan
+func (s *Solana) scan(ctx context.Context, a repo.DepositAddress) {
+	if a.Address != s.derive(a.ObfID) {
+		log.Printf("Deposit address for %s doesn't match the master key, not watching it", a.ObfID)
+		return
+	}
+
+	sigs, err := s.client.Signatures(ctx, a.Address, a.Cursor)
+	if err != nil {
+		log.Printf("Error listing transactions for %s: %v", a.Address, err)
+		return
+	}
+
+	// oldest first, so the cursor only ever moves past transactions that
+	// have been dealt with
+	for i := len(sigs) - 1; i >= 0; i-- {
+		if !sigs[i].Failed() {
+			if err := s.record(ctx, a, sigs[i].Signature); err != nil {
+				log.Printf("Error recording Solana deposit: obfID=%s, signature=%s: %v", a.ObfID, sigs[i].Signature, err)
+				return
+			}
+		}
+		if err := s.addresses.SetCursor(ctx, a.ObfID, sigs[i].Signature); err != nil {
+			log.Printf("Error moving cursor for %s: %v", a.Address, err)
+			return
+		}
+	}
+}
+
+// record turns a transfer to a deposit address into a pending deposit, and
+// credits it straight away if it's already deep enough
+func (s *Solana) record(ctx context.Context, a repo.DepositAddress, signature string) error {
+	tx, err := s.client.Transaction(ctx, signature)
+	if err != nil {
+		return err
+	}
+	received := tx.Received(a.Address)
+	if tx.Failed || received <= 0 {
+		// money going out, like the address being swept
+		return nil
+	}
+
+	d := repo.Deposit{
+		ID:          "dep_" + uuid.NewString(),
+		ObfID:       a.ObfID,
+		Method:      "solana",
+		Currency:    "solana",
+		Amount:      money.Amount(received),
+		Status:      StatusPending,
+		TxSignature: signature,
+	}
+	// whoever paid the fee, as near to "who sent it" as a transaction gets
+	if len(tx.Signers) > 0 {
+		d.Wallet = tx.Signers[0]
+	}
+	// a transaction is only ever recorded once for each player, so going
+	// over it again after a lost cursor update can't credit it twice
+	err = s.deposits.Create(ctx, d)
+	if errors.Is(err, repo.ErrDuplicate) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Solana deposit pending: id=%s, obfID=%s, from=%s, signature=%s, slot=%d",
+		d.ID, d.ObfID, d.Wallet, signature, tx.Slot)
+
+	if _, err := s.confirmIfDeep(ctx, d, tx); err != nil {
+		// it's recorded, confirmPending will have another go
+		log.Printf("Error confirming Solana deposit %s: %v", d.ID, err)
+	}
+	return nil
+}
+
+// confirmPending credits the pending deposits that have become deep enough
+func (s *Solana) confirmPending(ctx context.Context) {
+	pending, err := s.deposits.ListPending(ctx, "solana")
+	if err != nil {
+		log.Printf("Error listing pending Solana deposits: %v", err)
+		return
+	}
+
+	for _, d := range pending {
+		// look it up again rather than trusting what we saw, a fork can drop
+		// or change a transaction that was only confirmed
+		tx, err := s.client.Transaction(ctx, d.TxSignature)
+		if errors.Is(err, solana.ErrNotFound) {
+			s.fail(ctx, d, "the transaction is no longer on chain")
+			continue
+		}
+		if err != nil {
+			log.Printf("Error checking Solana deposit %s: %v", d.ID, err)
+			continue
+		}
+		if tx.Failed || money.Amount(tx.Received(s.derive(d.ObfID))) != d.Amount {
+			s.fail(ctx, d, "the transaction changed on chain")
+			continue
+		}
+
+		if _, err := s.confirmIfDeep(ctx, d, tx); err != nil {
+			log.Printf("Error confirming Solana deposit %s: %v", d.ID, err)
+		}
+	}
+}
+
+// confirmIfDeep credits d once enough slots have landed on top of its
+// transaction, and leaves it pending until then
+func (s *Solana) confirmIfDeep(ctx context.Context, d repo.Deposit, tx *solana.Transaction) (repo.Deposit, error) {
+	slot, err := s.client.Slot(ctx)
+	if err != nil {
+		return d, err
+	}
+	if slot < tx.Slot+s.confirmations {
+		return d, nil
+	}
+
+	// the address stops being watched when the account closes, but a
+	// transfer can land in between. Staff send it back, it isn't credited
+	u, err := s.users.FindByObfID(ctx, d.ObfID)
+	if err != nil {
+		return d, err
+	}
+	if u.Closed() {
+		s.fail(ctx, d, "the account is closed")
+		return s.deposits.Find(ctx, d.ID)
+	}
+
+	p, err := s.books.Posting(ledger.KindDeposit, d.ObfID, d.Currency, d.Amount, "solana:"+d.TxSignature)
+	if err != nil {
+		return d, err
+	}
+	// confirmed and credited in one transaction, so it's either still
+	// pending for the watcher to try again or it's done. Only one of two
+	// watchers racing each other gets to credit it
+	txID, err := s.deposits.Credit(ctx, d.ID, StatusPending, StatusConfirmed, "", p)
+	if errors.Is(err, repo.ErrNotFound) {
+		return s.deposits.Find(ctx, d.ID)
+	}
+	if err != nil {
+		return d, err
+	}
+
+	cur, _ := currency.Lookup(d.Currency)
+	log.Printf("Solana deposit confirmed: id=%s, obfID=%s, signature=%s, amount=%s, depth=%d, txID=%s",
+		d.ID, d.ObfID, d.TxSignature, cur.Format(d.Amount), slot-tx.Slot, txID)
+	d.Status = StatusConfirmed
+	return d, nil
+}
+
+func (s *Solana) fail(ctx context.Context, d repo.Deposit, reason string) {
+	if err := s.deposits.Transition(ctx, d.ID, StatusPending, StatusFailed, reason); err != nil {
+		log.Printf("Error failing Solana deposit %s: %v", d.ID, err)
+		return
+	}
+	log.Printf("Solana deposit failed: id=%s, obfID=%s, signature=%s, reason=%s", d.ID, d.ObfID, d.TxSignature, reason)
+}
@@ -0,0 +1,194 @@
+package deposit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/solana"
+)
+
+// testSolana watches deposits on a stub node, for alice, who has an account
+// and a deposit address. It returns her address as well
+func testSolana(t *testing.T, confirmations int) (*Solana, *solana.Stub, *repo.Repos, *ledger.Ledger, string) {
+	t.Helper()
+	stub := solana.NewStub()
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+
+	repos := repo.NewMemory()
+	books := ledger.New(repos.Balances)
+	ctx := context.Background()
+	if err := repos.Users.Create(ctx, repo.User{OAuthID: "alice", Email: "alice@example.com", Provider: "dev", ObfID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSolana(repos.Deposits, repos.Addresses, repos.Users, books, config.Solana{
+		RPCURL:        srv.URL,
+		MasterKey:     "test-master-key",
+		Confirmations: confirmations,
+		PollInterval:  time.Hour,
+	})
+	address, err := s.AddressFor(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, stub, repos, books, address
+}
+
+// wallet is somewhere outside for the test to send SOL from
+func wallet() string {
+	return solana.Address(solana.DeriveKey([]byte("test-wallet"), "alice").Public().(ed25519.PublicKey))
+}
+
+func checkSolana(t *testing.T, repos *repo.Repos, books *ledger.Ledger, status string, credited money.Amount) repo.Deposit {
+	t.Helper()
+	ctx := context.Background()
+	deposits, err := repos.Deposits.ListByUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deposits) != 1 {
+		t.Fatalf("%d deposits recorded, want 1", len(deposits))
+	}
+	if deposits[0].Status != status {
+		t.Errorf("deposit is %s, want %s", deposits[0].Status, status)
+	}
+	balances, err := books.Balances(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balances["solana"] != credited {
+		t.Errorf("balance is %d, want %d", balances["solana"], credited)
+	}
+	return deposits[0]
+}
+
+// TestSolanaReplayed goes over the same transaction again, after the cursor
+// is lost and from several watchers at once. It must only be credited once
+func TestSolanaReplayed(t *testing.T) {
+	s, stub, repos, books, address := testSolana(t, 0)
+	ctx := context.Background()
+
+	signature, err := stub.Transfer(wallet(), address, 1_000_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.watch(ctx)
+	d := checkSolana(t, repos, books, StatusConfirmed, 1_000_000)
+	if d.TxSignature != signature {
+		t.Fatalf("deposit has signature %s, want %s", d.TxSignature, signature)
+	}
+
+	if err := repos.Addresses.SetCursor(ctx, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.watch(ctx)
+		}()
+	}
+	wg.Wait()
+	checkSolana(t, repos, books, StatusConfirmed, 1_000_000)
+}
+
+// TestSolanaConfirmationDepth checks a transfer waits for enough slots on
+// top of it before it's credited
+func TestSolanaConfirmationDepth(t *testing.T) {
+	const confirmations = 2
+	s, stub, repos, books, address := testSolana(t, confirmations)
+	ctx := context.Background()
+
+	signature, err := stub.Transfer(wallet(), address, 1_000_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := s.client.Transaction(ctx, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for stub.Slot() < tx.Slot+confirmations {
+		if time.Now().After(deadline) {
+			t.Fatal("the stub chain stopped growing")
+		}
+		s.watch(ctx)
+		// the stub might have moved on since the watcher looked
+		if stub.Slot() < tx.Slot+confirmations {
+			checkSolana(t, repos, books, StatusPending, 0)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s.watch(ctx)
+	checkSolana(t, repos, books, StatusConfirmed, 1_000_000)
+}
+
+// TestSolanaVanished checks a pending deposit whose transaction is no longer
+// on chain, after a fork, fails rather than waiting forever
+func TestSolanaVanished(t *testing.T) {
+	s, _, repos, books, _ := testSolana(t, 1)
+	ctx := context.Background()
+
+	// signed by someone, but never landed on the stub's chain
+	sig := ed25519.Sign(solana.DeriveKey([]byte("test-wallet"), "fork"), []byte("dropped"))
+	err := repos.Deposits.Create(ctx, repo.Deposit{
+		ID:          "dep_vanished",
+		ObfID:       "alice",
+		Method:      "solana",
+		Currency:    "solana",
+		Amount:      1_000_000,
+		Status:      StatusPending,
+		TxSignature: solana.Address(sig),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.confirmPending(ctx)
+	d := checkSolana(t, repos, books, StatusFailed, 0)
+	if d.FailureReason != "the transaction is no longer on chain" {
+		t.Errorf("failure reason is %q", d.FailureReason)
+	}
+}
+
+// TestSolanaAccountClosing checks an account can't close under a transfer
+// that's still confirming, and the transfer is credited as usual
+func TestSolanaAccountClosing(t *testing.T) {
+	const confirmations = 2
+	s, stub, repos, books, address := testSolana(t, confirmations)
+	ctx := context.Background()
+
+	signature, err := stub.Transfer(wallet(), address, 1_000_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := s.client.Transaction(ctx, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.watch(ctx)
+	if stub.Slot() < tx.Slot+confirmations {
+		checkSolana(t, repos, books, StatusPending, 0)
+		if err := repos.Users.Close(ctx, "alice"); !errors.Is(err, repo.ErrAccountBusy) {
+			t.Fatalf("closing with a deposit pending: err = %v, want ErrAccountBusy", err)
+		}
+	}
+
+	for stub.Slot() < tx.Slot+confirmations {
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.watch(ctx)
+	checkSolana(t, repos, books, StatusConfirmed, 1_000_000)
+}
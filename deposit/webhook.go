@@ -0,0 +1,74 @@
+package deposit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries a webhook's signature, "t=<unix time>,v1=<hex hmac>".
+// The HMAC covers the time and the body, so an old webhook can't be replayed
+const SignatureHeader = "Processor-Signature"
+
+// webhookTolerance is how old a webhook's signature can be
+const webhookTolerance = 5 * time.Minute
+
+// signWebhook is what the processor puts in SignatureHeader
+func signWebhook(secret string, body []byte, at time.Time) string {
+	t := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + t + ",v1=" + webhookMAC(secret, t, body)
+}
+
+func webhookMAC(secret, t string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseSignedWebhook checks the signature on a webhook and decodes it.
+// Without a secret anyone could sign one, so nothing is accepted
+func parseSignedWebhook(secret string, r *http.Request) (WebhookEvent, error) {
+	var event WebhookEvent
+	if secret == "" {
+		return event, errors.New("no webhook secret is set")
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return event, fmt.Errorf("error reading webhook: %w", err)
+	}
+
+	var t, sig string
+	for _, part := range strings.Split(r.Header.Get(SignatureHeader), ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			t = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || sig == "" {
+		return event, errors.New("webhook isn't signed")
+	}
+	if !hmac.Equal([]byte(sig), []byte(webhookMAC(secret, t, body))) {
+		return event, errors.New("webhook signature doesn't match")
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > webhookTolerance || age < -webhookTolerance {
+		return event, errors.New("webhook signature has expired")
+	}
+
+	if err := json.Unmarshal(body, &event); err != nil {
+		return event, fmt.Errorf("error decoding webhook: %w", err)
+	}
+	return event, nil
+}
@@ -2,8 +2,10 @@ package hand
 
 import (
 	"github.com/Scrimzay/blackjackgame/deck"
+	"github.com/Scrimzay/blackjackgame/money"
 	"fmt"
 	"strings"
+	"time"
 )
 
 type Hand []deck.Card
@@ -50,9 +52,10 @@ func min(a, b int) int {
 	return b
 }
 
-func Shuffle(gs GameState) GameState {
+// Shuffle replaces the deck with a freshly shuffled shoe of the given number of decks
+func Shuffle(gs GameState, decks int) GameState {
 	ret := clone(gs)
-	ret.Deck = deck.New(deck.Deck(3), deck.Shuffle)
+	ret.Deck = deck.New(deck.Deck(decks), deck.Shuffle)
 	return ret
 }
 
@@ -139,15 +142,75 @@ const (
 	StatePlayerTurn State = iota
 	StateDealerTurn
 	StateHandOver
+	StateBetPlaced // a bet is down and the cards haven't been dealt yet
 )
 
+func (s State) String() string {
+	switch s {
+	case StatePlayerTurn:
+		return "player turn"
+	case StateDealerTurn:
+		return "dealer turn"
+	case StateHandOver:
+		return "hand over"
+	case StateBetPlaced:
+		return "bet placed"
+	default:
+		return "unknown"
+	}
+}
+
 type GameState struct {
 	Deck []deck.Card
 	State State
 	Player Hand
 	Dealer Hand
-	BetAmount float64
+	BetAmount money.Amount // in the minor unit of BetCurrency
 	BetCurrency string // added tot rack bet currency (cash/sol/etc)
+	Owner string // obfuscated id of the player who placed the bet
+	LastActive time.Time // last time a player touched the table
+}
+
+// Outcome is how a finished hand went for the player
+type Outcome int8
+
+const (
+	OutcomeLose Outcome = iota
+	OutcomePush
+	OutcomeWin
+	OutcomeBlackjack // a win on the first two cards, paid 3:2
+)
+
+// Blackjack reports whether the hand is a natural, 21 on its first two cards
+func (h Hand) Blackjack() bool {
+	return len(h) == 2 && h.Score() == 21
+}
+
+// Outcome scores a finished hand the same way the game page does
+func (gs GameState) Outcome() Outcome {
+	pScore, dScore := gs.Player.Score(), gs.Dealer.Score()
+	switch {
+	case gs.Player.Blackjack() && gs.Dealer.Blackjack():
+		return OutcomePush
+	case gs.Player.Blackjack():
+		return OutcomeBlackjack
+	case gs.Dealer.Blackjack():
+		return OutcomeLose
+	case pScore > 21:
+		return OutcomeLose
+	case dScore > 21, pScore > dScore:
+		return OutcomeWin
+	case dScore > pScore:
+		return OutcomeLose
+	default:
+		return OutcomePush
+	}
+}
+
+// BetInProgress reports whether a bet is riding on a hand that hasn't
+// finished, including one that hasn't been dealt yet
+func (gs GameState) BetInProgress() bool {
+	return gs.BetAmount > 0 && gs.State != StateHandOver
 }
 
 func (gs *GameState) CurrentPlayer() *Hand {
@@ -169,6 +232,8 @@ func clone(gs GameState) GameState {
 		Dealer: make(Hand, len(gs.Dealer)),
 		BetAmount: gs.BetAmount,
 		BetCurrency: gs.BetCurrency,
+		Owner: gs.Owner,
+		LastActive: gs.LastActive,
 	}
 	copy(ret.Deck, gs.Deck)
 	copy(ret.Player, gs.Player)
@@ -0,0 +1,45 @@
+package history
+
+import (
+	"context"
+
+	"github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/loglogger"
+)
+
+var (
+	log *logger.Logger
+)
+
+func init() {
+	var err error
+	log, err = logger.New("historylog.txt")
+	if err != nil {
+		log.Fatalf("Failed to start new logger in history: %v", err)
+	}
+}
+
+// actions recorded against a hand
+const (
+	ActionExpiredStand  = "expired_stand"  // table expired, hand was auto-stood
+	ActionExpiredRefund = "expired_refund" // table expired, bet was refunded
+	ActionExpired       = "expired"        // table expired with no bet on it
+	ActionSettled       = "settled"        // staff played the hand out and paid it
+	ActionVoided        = "voided"         // staff called the round off and refunded the bet
+	ActionClosed        = "closed"         // staff closed the table
+)
+
+// Entry is one line of the hand history
+type Entry = repo.HistoryEntry
+
+// Record writes the entry to the hand history
+func Record(ctx context.Context, games repo.GameRepo, e Entry) error {
+	if err := games.RecordHistory(ctx, e); err != nil {
+		return err
+	}
+
+	log.Printf("Hand history: gameID=%s, obfID=%s, action=%s, bet=%s %s\n",
+		e.GameID, e.ObfID, e.Action, currency.Format(e.BetCurrency, e.BetAmount), e.BetCurrency)
+	return nil
+}
@@ -0,0 +1,237 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Scrimzay/blackjackgame/audit"
+	currencies "github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/loglogger"
+)
+
+var (
+	log *logger.Logger
+)
+
+func init() {
+	var err error
+	log, err = logger.New("ledgerlog.txt")
+	if err != nil {
+		log.Fatalf("Failed to start new logger in ledger: %v", err)
+	}
+}
+
+// Kind is the reason money moved
+type Kind string
+
+const (
+	KindDeposit      Kind = "deposit"
+	KindBet          Kind = "bet"
+	KindPayout       Kind = "payout"
+	KindRefund       Kind = "refund"
+	KindWithdrawal   Kind = "withdrawal"
+	KindTopUp        Kind = "topup"         // free play money, never a real currency
+	KindOpening      Kind = "opening"       // a balance from before the ledger, posted by migration 0004, never by Record
+	KindRekey        Kind = "rekey"         // moved to a new obfuscated id by migration 0008, never posted by Record
+	KindAdjustCredit Kind = "adjust_credit" // manual correction by an admin, in the player's favour
+	KindAdjustDebit  Kind = "adjust_debit"  // manual correction by an admin, against the player
+	KindChargeback   Kind = "chargeback"    // the processor handed a card deposit back to the card
+)
+
+// ErrInsufficientFunds is returned when a debit would take a balance below zero
+var ErrInsufficientFunds = repo.ErrInsufficientFunds
+
+// HouseAccount is the other side of every player posting
+const HouseAccount = repo.HouseAccount
+
+// Ledger is the double-entry journal. Every balance change goes through it
+// so the balances table is only ever a cache of the journal
+type Ledger struct {
+	balances repo.BalanceRepo
+}
+
+// New builds a ledger on top of the balance repository. Every posting's
+// audit event goes through the repository too, in the posting's transaction
+func New(balances repo.BalanceRepo) *Ledger {
+	return &Ledger{balances: balances}
+}
+
+// Record journals amount moving between the player and the house and applies
+// it to the player's cached balance in one transaction. Entries are never
+// updated or deleted, a mistake is fixed with another posting.
+// It returns the journal transaction id
+func (l *Ledger) Record(ctx context.Context, kind Kind, obfID, currency string, amount money.Amount, reference string) (string, error) {
+	p, err := l.Posting(kind, obfID, currency, amount, reference)
+	if err != nil {
+		return "", err
+	}
+	txID, err := l.balances.Post(ctx, p)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Ledger %s: txID=%s, obfID=%s, amount=%s %s, reference=%s\n",
+		kind, txID, obfID, currencies.Format(currency, p.Amount), currency, reference)
+	return txID, nil
+}
+
+// Posting checks and builds the posting Record would make, for a repository
+// that journals it in a transaction of its own, like a deposit's status
+// moving to confirmed along with its credit
+func (l *Ledger) Posting(kind Kind, obfID, currency string, amount money.Amount, reference string) (repo.Posting, error) {
+	cur, ok := currencies.Lookup(currency)
+	if !ok {
+		return repo.Posting{}, fmt.Errorf("invalid currency: %s", currency)
+	}
+	// play money can't be bought or cashed out, and real money is never free
+	if cur.PlayMoney && (kind == KindDeposit || kind == KindWithdrawal) {
+		return repo.Posting{}, fmt.Errorf("cannot %s play money", kind)
+	}
+	if !cur.PlayMoney && kind == KindTopUp {
+		return repo.Posting{}, fmt.Errorf("cannot top up %s", currency)
+	}
+	if amount <= 0 {
+		return repo.Posting{}, fmt.Errorf("invalid amount: %d", amount)
+	}
+
+	// deposits, payouts, refunds, top ups and credit adjustments credit the
+	// player, bets, withdrawals, debit adjustments and chargebacks debit them
+	delta := amount
+	switch kind {
+	case KindDeposit, KindPayout, KindRefund, KindTopUp, KindAdjustCredit:
+	case KindBet, KindWithdrawal, KindAdjustDebit, KindChargeback:
+		delta = -amount
+	default:
+		return repo.Posting{}, fmt.Errorf("invalid ledger entry kind: %s", kind)
+	}
+
+	// the player moved the money for deposits, bets and withdrawals, the
+	// server did for everything else
+	actor := audit.ActorSystem
+	switch kind {
+	case KindDeposit, KindBet, KindWithdrawal:
+		actor = obfID
+	}
+
+	return repo.Posting{
+		Kind:      string(kind),
+		ObfID:     obfID,
+		Currency:  currency,
+		Amount:    delta,
+		Reference: reference,
+		Audit:     auditPosting(actor),
+	}, nil
+}
+
+// auditPosting builds a posting's audit event. The balance repository
+// queues it in the same transaction as the journal entries, so a posting
+// can't commit without its event or the other way round
+func auditPosting(actor string) func(p repo.Posting, txID string) (repo.Event, error) {
+	return func(p repo.Posting, txID string) (repo.Event, error) {
+		return audit.NewEvent(audit.TypeLedger, actor, p.ObfID, audit.Data{
+			"kind":      p.Kind,
+			"txID":      txID,
+			"currency":  p.Currency,
+			"amount":    p.Amount,
+			"reference": p.Reference,
+		})
+	}
+}
+
+// TopUp refills a play money balance to allowance, at most once a day.
+// It returns how much was added
+func (l *Ledger) TopUp(ctx context.Context, obfID, currency string, allowance money.Amount) (money.Amount, error) {
+	cur, ok := currencies.Lookup(currency)
+	if !ok || !cur.PlayMoney {
+		return 0, fmt.Errorf("cannot top up %s", currency)
+	}
+
+	added, err := l.balances.TopUp(ctx, repo.Posting{
+		Kind:      string(KindTopUp),
+		ObfID:     obfID,
+		Currency:  currency,
+		Reference: "daily",
+		Audit:     auditPosting(audit.ActorSystem),
+	}, allowance)
+	if err != nil {
+		return 0, err
+	}
+
+	if added > 0 {
+		log.Printf("Ledger %s: obfID=%s, amount=%s %s\n", KindTopUp, obfID, cur.Format(added), currency)
+	}
+	return added, nil
+}
+
+// Balances returns the player's cached balance in every currency they hold
+func (l *Ledger) Balances(ctx context.Context, obfID string) (map[string]money.Amount, error) {
+	return l.balances.Balances(ctx, obfID)
+}
+
+// TopBalances returns the players holding the most of a currency
+func (l *Ledger) TopBalances(ctx context.Context, currency string, limit int) ([]repo.Standing, error) {
+	return l.balances.TopBalances(ctx, currency, limit)
+}
+
+// Drift is a cached balance that disagrees with the journal
+type Drift struct {
+	ObfID    string
+	Currency string
+	Balance  money.Amount
+	Journal  money.Amount
+}
+
+// Report is the result of a reconciliation run
+type Report struct {
+	Drifts     []Drift
+	Unbalanced []string // journal transactions whose legs don't sum to zero
+}
+
+// OK reports whether the reconciliation found nothing wrong
+func (r Report) OK() bool {
+	return len(r.Drifts) == 0 && len(r.Unbalanced) == 0
+}
+
+// Reconcile checks every cached balance against the sum of its journal
+// entries and every journal transaction against the double-entry rule
+func (l *Ledger) Reconcile(ctx context.Context) (Report, error) {
+	var report Report
+
+	// what the journal says each player should have
+	journal, err := l.balances.JournalSums(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	// what the balances table says they have
+	balances, err := l.balances.AllBalances(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	for obfID, held := range balances {
+		for currency, balance := range held {
+			if sum := journal[obfID][currency]; sum != balance {
+				report.Drifts = append(report.Drifts, Drift{obfID, currency, balance, sum})
+			}
+			// checked, anything left in journal has no balance row at all
+			delete(journal[obfID], currency)
+		}
+	}
+	for obfID, sums := range journal {
+		for currency, sum := range sums {
+			if sum != 0 {
+				report.Drifts = append(report.Drifts, Drift{obfID, currency, 0, sum})
+			}
+		}
+	}
+
+	report.Unbalanced, err = l.balances.UnbalancedTransactions(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,205 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/audit"
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/db"
+	"github.com/Scrimzay/blackjackgame/migrations"
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/google/uuid"
+)
+
+func TestConcurrentBetsMemory(t *testing.T) {
+	testConcurrentBets(t, repo.NewMemory())
+}
+
+// TEST_DATABASE_URL points at a scratch database, the test migrates it and
+// plays with a player of its own so it can be run more than once
+func TestConcurrentBetsPostgres(t *testing.T) {
+	testConcurrentBets(t, testPostgres(t))
+}
+
+func testPostgres(tb testing.TB) *repo.Repos {
+	tb.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		tb.Skip("TEST_DATABASE_URL not set")
+	}
+	database, err := db.Open(config.DB{DSN: dsn, MaxOpenConns: 20, MaxIdleConns: 20, ConnMaxLifetime: time.Minute})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { database.Close() })
+	if _, err := migrations.Up(database); err != nil {
+		tb.Fatal(err)
+	}
+	return repo.NewPostgres(database)
+}
+
+func BenchmarkConcurrentBetsMemory(b *testing.B) {
+	benchmarkConcurrentBets(b, repo.NewMemory())
+}
+
+func BenchmarkConcurrentBetsPostgres(b *testing.B) {
+	benchmarkConcurrentBets(b, testPostgres(b))
+}
+
+// benchmarkConcurrentBets has players at different tables betting at once.
+// Nothing they touch is shared but the audit log, so bets per second should
+// go up with the number of players rather than stay where one player gets
+func benchmarkConcurrentBets(b *testing.B, repos *repo.Repos) {
+	ctx := context.Background()
+	books := New(repos.Balances)
+	b.RunParallel(func(pb *testing.PB) {
+		obfID := "bench-" + uuid.NewString()
+		if _, err := books.Record(ctx, KindAdjustCredit, obfID, "cash", money.Amount(b.N)*100, "bench"); err != nil {
+			b.Error(err)
+			return
+		}
+		for pb.Next() {
+			if _, err := books.Record(ctx, KindBet, obfID, "cash", 100, "bench"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	if _, err := audit.New(repos.Events).Chain(ctx); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// testConcurrentBets races more bets than the balance covers against one
+// player. Exactly as many as fit must go through and the balance must never
+// go below zero
+func testConcurrentBets(t *testing.T, repos *repo.Repos) {
+	ctx := context.Background()
+	books := New(repos.Balances)
+	obfID := "test-" + uuid.NewString()
+
+	const balance, stake, bets = money.Amount(1000), money.Amount(70), 50
+	if _, err := books.Record(ctx, KindAdjustCredit, obfID, "cash", balance, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	var debited, refused atomic.Int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < bets; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := books.Record(ctx, KindBet, obfID, "cash", stake, "test")
+			switch {
+			case err == nil:
+				debited.Add(1)
+			case errors.Is(err, ErrInsufficientFunds):
+				refused.Add(1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if want := int64(balance / stake); debited.Load() != want {
+		t.Fatalf("%d bets debited, want %d", debited.Load(), want)
+	}
+	if debited.Load()+refused.Load() != bets {
+		t.Fatalf("%d debited and %d refused, want %d in all", debited.Load(), refused.Load(), bets)
+	}
+
+	balances, err := books.Balances(ctx, obfID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := balance - stake*money.Amount(debited.Load()); balances["cash"] != want {
+		t.Fatalf("balance is %d, want %d", balances["cash"], want)
+	}
+	if balances["cash"] < 0 {
+		t.Fatalf("balance went negative: %d", balances["cash"])
+	}
+}
+
+// TestPostingsAudited checks every posting that went through has exactly one
+// audit event with its transaction id, and a refused one has none
+func TestPostingsAudited(t *testing.T) {
+	ctx := context.Background()
+	repos := repo.NewMemory()
+	books := New(repos.Balances)
+
+	if _, err := books.Record(ctx, KindAdjustCredit, "alice", "cash", 500, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := books.Record(ctx, KindBet, "alice", "cash", 200, "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := books.Record(ctx, KindBet, "alice", "cash", 1000, "t1"); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("overspending bet: err = %v, want ErrInsufficientFunds", err)
+	}
+	if _, err := books.TopUp(ctx, "alice", "chips", 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// the events are queued until they're chained, and an event recorded
+	// on its own in the meantime goes in ahead of them
+	trail := audit.New(repos.Events)
+	if err := trail.Record(ctx, audit.TypeLogin, "alice", "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	chained, err := trail.Chain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chained != 3 {
+		t.Fatalf("%d audit events chained, want 3", chained)
+	}
+
+	events, err := repos.Events.Events(ctx, 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audited := make(map[string]int)
+	for _, e := range events {
+		var data struct {
+			TxID string `json:"txID"`
+		}
+		if err := json.Unmarshal([]byte(e.Data), &data); err != nil {
+			t.Fatal(err)
+		}
+		audited[data.TxID]++
+	}
+
+	journal, err := repos.Balances.Journal(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal) != 3 || len(events) != 3 {
+		t.Fatalf("%d postings and %d audit events, want 3 of each", len(journal), len(events))
+	}
+	for _, entry := range journal {
+		if audited[entry.TxID] != 1 {
+			t.Errorf("posting %s has %d audit events, want 1", entry.TxID, audited[entry.TxID])
+		}
+	}
+
+	report, err := audit.Verify(ctx, repos.Events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("audit chain broken: %+v", report.Problems)
+	}
+}
@@ -1,30 +1,36 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"os"
-	"strconv"
-	"sync"
+	"time"
 
+	"github.com/Scrimzay/blackjackgame/admin"
+	"github.com/Scrimzay/blackjackgame/audit"
 	"github.com/Scrimzay/blackjackgame/auth"
+	"github.com/Scrimzay/blackjackgame/chips"
+	"github.com/Scrimzay/blackjackgame/config"
 	"github.com/Scrimzay/blackjackgame/deposit"
+	"github.com/Scrimzay/blackjackgame/currency"
 	"github.com/Scrimzay/blackjackgame/db"
 	"github.com/Scrimzay/blackjackgame/deck"
 	"github.com/Scrimzay/blackjackgame/hand"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/migrations"
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/blackjackgame/session"
 
 	"github.com/Scrimzay/loglogger"
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/sessions"
-	"github.com/joho/godotenv"
 )
 
 var (
 	log *logger.Logger
-	games = make(map[string]*hand.GameState) // store game states
-	gamesMu sync.Mutex // mutex to protect concurrect access to game
-	store *sessions.CookieStore
 )
 
 func init() {
@@ -35,41 +41,70 @@ func init() {
 	}
 }
 
-func authRequired(store *sessions.CookieStore) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		err := godotenv.Load(".env")
+func main() {
+	// settings come from the env, .env and flags, once, before anything starts
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	// anything left after the flags is a maintenance command, not the server
+	if len(args) > 0 {
+		runCommand(cfg, args)
+		return
+	}
+
+	r := gin.Default()
+
+	// DB_BACKEND=memory runs everything in process with no Postgres at all,
+	// for local development and tests
+	var repos *repo.Repos
+	switch cfg.DB.Backend {
+	case "postgres":
+		// one pool for the whole server, handed to everything that needs the DB
+		database, err := db.Open(cfg.DB)
 		if err != nil {
-			log.Fatalf("Error loading .env file in auth: %v", err)
+			log.Fatalf("Error connecting to DB: %v", err)
 		}
-		sessionKey := os.Getenv("SESSION_SECRET")
-		if sessionKey == "" {
-			log.Fatal("Session secret not loaded.")
-			return
-		}
-		store = sessions.NewCookieStore([]byte(sessionKey))
-		session, err := store.Get(c.Request, "session-name")
-		if err != nil {
-			fmt.Println("Error getting session, most likely not signed in")
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
+		defer database.Close()
+
+		// bring the schema up to date unless the deployment runs `migrate` itself
+		if cfg.DB.MigrateOnStart {
+			applied, err := migrations.Up(database)
+			if err != nil {
+				log.Fatalf("Error running migrations: %v", err)
+			}
+			fmt.Printf("Applied %d migrations\n", applied)
 		}
 
-		// Check if user is already authenticated
-		if userID, ok := session.Values["user_id"]; ok && userID != "" {
-			// User is authenticated, proceed with request
-			c.Next()
-		} else {
-			// User is not authenticated, redirect to login
-			c.Redirect(http.StatusFound ,"/login")
-			c.Abort()
-		}
+		repos = repo.NewPostgres(database)
+	case "memory":
+		fmt.Println("Using the in-memory backend, nothing will be saved")
+		repos = repo.NewMemory()
 	}
-}
-
-func main() {
-	r := gin.Default()
-	db.ConnectToDatabase()
-	auth.ConnectToProvider()
+	// logins, money and account changes all go to the tamper evident audit trail
+	trail := audit.New(repos.Events)
+	trail.StartChainer(time.Second)
+	books := ledger.New(repos.Balances)
+
+	// one session store for auth, deposits and the tables
+	sess := session.New(cfg, repos.Sessions, trail)
+	sess.StartSweeper(10 * time.Minute)
+	if err := auth.ConnectToProvider(cfg, sess); err != nil {
+		log.Fatalf("Error connecting to auth providers: %v", err)
+	}
+	processor, err := deposit.NewProcessor(cfg.Payments, cfg.BaseURL+"/deposit/webhook")
+	if err != nil {
+		log.Fatalf("Error setting up payment processor: %v", err)
+	}
+	deposits := deposit.NewService(repos.Deposits, books, processor)
+	var solanaDeposits *deposit.Solana
+	if cfg.Solana.RPCURL != "" {
+		solanaDeposits = deposit.NewSolana(repos.Deposits, repos.Addresses, repos.Users, books, cfg.Solana)
+		solanaDeposits.StartWatcher()
+	}
+	configureTables(cfg.Tables)
+	startReaper(cfg.Tables, books, repos.Games)
 
 	// Register custom template function
 	r.SetFuncMap(template.FuncMap{
@@ -80,23 +115,65 @@ func main() {
 	r.LoadHTMLGlob("templates/*.html")
 	r.Static("/static", "./static")
 
+	// every request gets the signed in user, if any, in its gin.Context
+	r.Use(sess.Load())
+	// every POST, PUT and DELETE needs the session's CSRF token, except the
+	// processor's webhooks which are signed instead
+	r.Use(sess.CSRF("/deposit/webhook"))
+	authRequired := session.Required()
+
 	r.GET("/", indexHandler)
-	r.GET("/login", loginGETHandler)
+	r.GET("/login", auth.LoginHandler)
 	r.GET("/auth/:provider", auth.BeginAuthHandler)
-	r.GET("/auth/:provider/callback", auth.CompleteAuthHandler)
-	r.GET("/logout", authRequired(store), auth.LogoutHandler)
-	r.GET("/delete", authRequired(store), auth.DeleteProfile)
-	r.DELETE("/deleteaccount")
-	r.GET("/deposit", authRequired(store), depositGETHandler)
-	r.POST("/deposit", authRequired(store), deposit.DepositPOSTHandler)
-	r.GET("/blackjack", authRequired(store), blackjackHandler)
-	r.GET("/blackjack/game/:id", authRequired(store), blackjackGameIDHandler)
-	r.POST("/blackjack/game/:id/deal", authRequired(store), blackjackDealHandler)
-	r.POST("/blackjack/game/:id/hit", authRequired(store), blackjackHitHandler)
-	r.POST("/blackjack/game/:id/stand", authRequired(store), blackjackStandHandler)
-	r.POST("/blackjack/game/:id/bet", authRequired(store), betHandler)
-
-	err := r.Run(":3000")
+	if cfg.HasProvider("dev") {
+		r.GET("/auth/dev/pick", auth.DevPickHandler)
+	}
+	r.GET("/auth/:provider/callback", auth.CompleteAuthHandler(repos.Users, sess, trail))
+	r.POST("/logout", authRequired, auth.LogoutHandler(sess))
+	r.GET("/account", authRequired, auth.AccountHandler(repos.Users))
+	r.POST("/account/unlink", authRequired, auth.UnlinkHandler(repos.Users, trail))
+	r.GET("/sessions", authRequired, auth.SessionsHandler(sess))
+	r.POST("/sessions/logout-all", authRequired, auth.LogoutEverywhereHandler(sess))
+	r.POST("/sessions/:id/revoke", authRequired, auth.RevokeSessionHandler(sess))
+	r.GET("/account/export", authRequired, auth.ExportHandler(repos, sess))
+	r.GET("/account/close", authRequired, auth.CloseAccountPageHandler(books, repos.Deposits, activeBets))
+	r.POST("/account/close", authRequired, auth.CloseAccountHandler(repos.Users, books, repos.Deposits, sess, activeBets, holdTables, trail))
+	r.DELETE("/deleteaccount", authRequired, auth.CloseAccountHandler(repos.Users, books, repos.Deposits, sess, activeBets, holdTables, trail))
+	r.GET("/delete", authRequired, func(c *gin.Context) {
+		// old link, closing now goes through the confirmation page
+		c.Redirect(http.StatusFound, "/account/close")
+	})
+	r.GET("/deposit", authRequired, deposit.DepositGETHandler(solanaDeposits))
+	r.POST("/deposit", authRequired, deposit.DepositPOSTHandler(deposits, solanaDeposits))
+	r.POST("/deposit/webhook", deposit.WebhookHandler(deposits))
+	r.GET("/deposit/:id", authRequired, deposit.DepositStatusHandler(deposits))
+	r.GET("/blackjack", authRequired, blackjackHandler)
+	r.GET("/blackjack/game/:id", authRequired, blackjackGameIDHandler(books))
+	r.POST("/blackjack/game/:id/deal", authRequired, blackjackDealHandler(books))
+	r.POST("/blackjack/game/:id/hit", authRequired, blackjackHitHandler(books))
+	r.POST("/blackjack/game/:id/stand", authRequired, blackjackStandHandler(books))
+	r.POST("/blackjack/game/:id/bet", authRequired, betHandler(books))
+	r.GET("/leaderboard", authRequired, leaderboardHandler(books))
+
+	// staff only. Support can look, only admins can change anything
+	staff := r.Group("/admin", admin.Require(repos.Users, admin.RoleSupport, admin.RoleAdmin))
+	adminOnly := admin.Require(repos.Users, admin.RoleAdmin)
+	auditor := admin.NewAuditor(repos.Audit, trail)
+	staff.GET("", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/admin/users")
+	})
+	staff.GET("/users", admin.UsersHandler(repos.Users))
+	staff.GET("/users/:obfID", admin.UserHandler(repos))
+	staff.POST("/users/:obfID/adjust", adminOnly, admin.AdjustHandler(repos.Users, books, auditor))
+	staff.POST("/users/:obfID/role", adminOnly, admin.RoleHandler(repos.Users, auditor))
+	tables := &tableConsole{books: books, games: repos.Games}
+	staff.GET("/tables", admin.TablesHandler(tables))
+	for _, action := range []string{"pause", "resume", "settle", "void", "close"} {
+		staff.POST("/tables/:id/"+action, adminOnly, admin.TableActionHandler(tables, auditor, action))
+	}
+	staff.GET("/audit", admin.AuditHandler(auditor))
+
+	err = r.Run(cfg.ListenAddr)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
@@ -106,240 +183,323 @@ func indexHandler(c *gin.Context) {
 	c.HTML(200, "index.html", nil)
 }
 
-func loginGETHandler(c *gin.Context) {
-	c.HTML(200, "login.html", nil)
-}
-
 func blackjackHandler(c *gin.Context) {
 	c.HTML(200, "blackjackIndex.html", nil)
 }
 
-func depositGETHandler(c *gin.Context) {
-	c.HTML(200, "deposit.html", nil)
-}
-
-func betHandler(c *gin.Context) {
-	gamesMu.Lock()
-	defer gamesMu.Unlock()
-	// Get the user's session
-	session, err := store.Get(c.Request, "session-name")
-	if err != nil {
-		fmt.Println("Error getting session:", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
+func leaderboardHandler(books *ledger.Ledger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := session.CurrentUser(c)
 
-	// Get the user's obfuscated ID from the session
-	obfID, ok := session.Values["obfuscated_id"].(string)
-	if !ok {
-		fmt.Println("Error: obfuscated_id not found in session")
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
+		standings, err := chips.Leaderboard(c.Request.Context(), books, 50)
+		if err != nil {
+			log.Print("Error fetching leaderboard:", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
 
-	betCurrency := c.PostForm("betCurrency")
-	betAmountStr := c.PostForm("betAmount")
+		chipsCurrency, _ := currency.Lookup(chips.Code)
+		rows := make([]gin.H, 0, len(standings))
+		for _, s := range standings {
+			rows = append(rows, gin.H{
+				"Rank": s.Rank,
+				"Player": leaderboardName(s.ObfID, user.ObfID),
+				"Chips": chipsCurrency.Display(s.Chips),
+			})
+		}
 
-	betAmount, err := strconv.ParseFloat(betAmountStr, 64)
-	if err != nil || betAmount <= 0 {
-		log.Print("Invalid bet amount:", err)
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
+		c.HTML(200, "leaderboard.html", gin.H{
+			"Standings": rows,
+		})
 	}
+}
 
-	db, err := db.ConnectToDatabase()
-	if err != nil {
-		log.Fatalf("Error connecting to DB in betHandler: %v", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+// leaderboardName is how a player shows up on the leaderboard. The
+// obfuscated id is what reaches an account, so everyone else only sees
+// enough of it to tell the rows apart
+func leaderboardName(obfID, viewer string) string {
+	if obfID == viewer {
+		return "You"
 	}
-	defer db.Close()
-
-	var cashBalance float64
-	var solanaBalance float64
-	query := `
-		select cash_balance, solana_balance
-		from balance
-		where obfuscatedid = $1
-	`
-	err = db.QueryRow(query, obfID).Scan(&cashBalance, &solanaBalance)
-	if err != nil {
-		fmt.Println("Error fetching balance:", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+	if len(obfID) > 6 {
+		obfID = obfID[:6]
 	}
+	return "Player " + obfID + "…"
+}
+
+func betHandler(books *ledger.Ledger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// the signed in user, put there by the session middleware
+		user, ok := session.CurrentUser(c)
+		if !ok {
+			log.Print("Error: no user in session")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		obfID := user.ObfID
+
+		betCurrency := c.PostForm("betCurrency")
+		betAmountStr := c.PostForm("betAmount")
 
-	switch betCurrency {
-	case "cash":
-		if betAmount > cashBalance {
-			fmt.Println("Insufficient cash balance")
+		cur, ok := currency.Lookup(betCurrency)
+		if !ok {
+			log.Print("Invalid bet currency:", betCurrency)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
-		cashBalance -= betAmount
 
-	case "solana":
-		if betAmount > solanaBalance {
-			fmt.Println("Insufficient Solana balance")
+		betAmount, err := cur.Parse(betAmountStr)
+		if err != nil {
+			log.Print("Invalid bet amount:", err)
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
-		solanaBalance -= betAmount
 
-	default:
-		fmt.Println("Invalid bet currency:", betCurrency)
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
-	}
+		// table limits for the currency
+		if err := cur.CheckBet(betAmount); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	updateQuery := `
-		update balance
-		set cash_balance = $1, solana_balance = $2
-		where obfuscatedid = $3
-	`
-	_, err = db.Exec(updateQuery, cashBalance, solanaBalance, obfID)
-	if err != nil {
-		log.Print("Error updating balance:", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
+		gameID := c.Param("id")
 
-	gameID := c.Param("id")
+		// free practice chips, once a day, before the first chips bet
+		if betCurrency == chips.Code {
+			if err := chips.TopUp(c.Request.Context(), books, obfID); err != nil {
+				log.Print("Error topping up chips:", err)
+			}
+		}
 
-	gs, exists := games[gameID]
-	if !exists {
-		gs = &hand.GameState{
-			Deck: hand.Shuffle(hand.GameState{}).Deck,
-			State: hand.StatePlayerTurn,
-			BetAmount: betAmount,
-			BetCurrency: betCurrency,
+		gs, err := takeBet(c.Request.Context(), books, gameID, obfID, betCurrency, betAmount)
+		switch {
+		case errors.Is(err, ledger.ErrInsufficientFunds):
+			log.Printf("Insufficient %s balance: obfID=%s", cur.Name, obfID)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Insufficient " + cur.Name + " balance"})
+			return
+		case errors.Is(err, errBetRiding), errors.Is(err, errNotYourTable), errors.Is(err, errClosedAccount):
+			log.Print("Bet refused:", err)
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, errTablePaused), errors.Is(err, errTableClosing):
+			// the page tells the player why
+			log.Print("Bet refused:", err)
+		case err != nil:
+			log.Print("Error placing bet:", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
 		}
-	} else {
-		gs.BetAmount = betAmount
-		gs.BetCurrency = betCurrency
-	}
 
-	renderGame(c, gs)
+		renderGame(c, gs, books)
+	}
 }
 
-func blackjackGameIDHandler(c *gin.Context) {
-	gameID := c.Param("id")
-	gamesMu.Lock()
-	defer gamesMu.Unlock()
+// takeBet debits the bet and puts it on the table, handing it back if the
+// table refuses it. It returns the game to show
+func takeBet(ctx context.Context, books *ledger.Ledger, gameID, obfID, betCurrency string, betAmount money.Amount) (hand.GameState, error) {
+	// journal the bet, this debits the balance in the same transaction and
+	// refuses if the balance can't cover it
+	if _, err := books.Record(ctx, ledger.KindBet, obfID, betCurrency, betAmount, gameID); err != nil {
+		return hand.GameState{}, err
+	}
 
-	// init a new game if it doesnt exist
-	if _, exists := games[gameID]; !exists {
-		games[gameID] = &hand.GameState{
-			Deck: hand.Shuffle(hand.GameState{}).Deck, // shuffle a new deck
-			State: hand.StatePlayerTurn,
+	// the balance is settled, only now take the table lock
+	gs, err := placeBet(gameID, obfID, betCurrency, betAmount)
+	if err != nil {
+		// staff paused or are closing the table, or it's taken, hand the
+		// bet back
+		if _, refundErr := books.Record(ctx, ledger.KindRefund, obfID, betCurrency, betAmount, gameID); refundErr != nil {
+			return gs, fmt.Errorf("error refunding refused bet: %w", refundErr)
 		}
 	}
-
-	renderGame(c, games[gameID])
+	return gs, err
 }
 
-func blackjackDealHandler(c *gin.Context) {
-	gameID := c.Param("id")
-	gamesMu.Lock()
-	defer gamesMu.Unlock()
-
-	gs, exists := games[gameID]
-	if !exists || gs == nil {
-		// Initialize a new game if it doesn't exist
-		gs = &hand.GameState{
-			Deck:  hand.Shuffle(hand.GameState{}).Deck, // Shuffle a new deck
-			State: hand.StatePlayerTurn,
-		}
-		games[gameID] = gs
+func blackjackGameIDHandler(books *ledger.Ledger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		gameID := c.Param("id")
+
+		// init a new game if it doesnt exist
+		gs, _ := withTable(gameID, true, func(gs *hand.GameState) {})
+
+		renderGame(c, gs, books)
 	}
-	*gs = hand.Deal(*gs) // deal cards
+}
 
-	renderGame(c, gs)
+func blackjackDealHandler(books *ledger.Ledger) gin.HandlerFunc {
+	return playHandler(books, true, func(gs *hand.GameState) {
+		// a hand with a bet on it can't be dealt again half way through
+		if gs.BetInProgress() && gs.State != hand.StateBetPlaced {
+			return
+		}
+		*gs = hand.Deal(*gs) // deal cards
+	})
 }
 
-func blackjackHitHandler(c *gin.Context) {
-	gameID := c.Param("id")
-	gamesMu.Lock()
-	defer gamesMu.Unlock()
+func blackjackHitHandler(books *ledger.Ledger) gin.HandlerFunc {
+	return playHandler(books, false, func(gs *hand.GameState) {
+		if gs.State != hand.StatePlayerTurn {
+			return
+		}
+		*gs = hand.Hit(*gs)
+	})
+}
 
-	gs := games[gameID]
-	*gs = hand.Hit(*gs)
+func blackjackStandHandler(books *ledger.Ledger) gin.HandlerFunc {
+	return playHandler(books, false, func(gs *hand.GameState) {
+		if gs.State != hand.StatePlayerTurn {
+			return
+		}
+		*gs = hand.Stand(*gs)
 
-	renderGame(c, gs)
+		// dealers turn
+		for gs.State == hand.StateDealerTurn {
+			*gs = hand.Hit(*gs)
+		}
+	})
 }
 
-func blackjackStandHandler(c *gin.Context) {
-	gameID := c.Param("id")
-	gamesMu.Lock()
-	defer gamesMu.Unlock()
+// playHandler runs one of the player's moves on the table in the URL
+func playHandler(books *ledger.Ledger, create bool, move func(gs *hand.GameState)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// the signed in user, put there by the session middleware
+		user, ok := session.CurrentUser(c)
+		if !ok {
+			log.Print("Error: no user in session")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
 
-	gs := games[gameID]
-	*gs = hand.Stand(*gs)
+		gs, exists, err := playMove(c.Request.Context(), books, c.Param("id"), user.ObfID, create, move)
+		if !exists {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errNotYourTable) {
+			log.Printf("Move refused: obfID=%s: %v", user.ObfID, err)
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
 
-	// dealers turn
-	for gs.State == hand.StateDealerTurn {
-		*gs = hand.Hit(*gs)
+		renderGame(c, gs, books)
 	}
+}
 
-	renderGame(c, gs)
+// playMove runs obfID's move under the table lock, and pays the hand out
+// through the ledger once the move has finished it. A table that belongs to
+// someone else is refused, so nobody can play out another player's bet. It
+// returns the game to show
+func playMove(ctx context.Context, books *ledger.Ledger, gameID, obfID string, create bool, move func(gs *hand.GameState)) (hand.GameState, bool, error) {
+	var settled hand.GameState
+	var finished bool
+	var refused error
+	gs, exists := withTable(gameID, create, func(gs *hand.GameState) {
+		if gs.Owner != "" && gs.Owner != obfID {
+			refused = errNotYourTable
+			return
+		}
+		move(gs)
+		settled, finished = takeSettlement(gs)
+	})
+	if !exists || refused != nil {
+		return gs, exists, refused
+	}
+	if !finished {
+		return gs, true, nil
+	}
+
+	// show the hand with the bet it was played for
+	if _, err := settleHand(ctx, books, gameID, settled); err != nil {
+		// the bet is off the table, staff have to pay this by hand
+		log.Printf("UNPAID HAND game=%s, obfID=%s, bet=%s %s: %v",
+			gameID, settled.Owner, currency.Format(settled.BetCurrency, settled.BetAmount), settled.BetCurrency, err)
+		return settled, true, err
+	}
+	return settled, true, nil
 }
 
-func renderGame(c *gin.Context, gs *hand.GameState) {
+// renderGame works on a copy of the game so the balance lookup below
+// happens without any table lock held
+func renderGame(c *gin.Context, gs hand.GameState, books *ledger.Ledger) {
 	// Ensure the dealer has at least one card
 	if len(gs.Dealer) == 0 {
 		gs.Dealer = make(hand.Hand, 0)
 	}
 
-	// Get the user's session
-	session, err := store.Get(c.Request, "session-name")
-	if err != nil {
-		fmt.Println("Error getting session:", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-
-	// Get the user's obfuscated ID from the session
-	obfID, ok := session.Values["obfuscated_id"].(string)
+	// the signed in user, put there by the session middleware
+	user, ok := session.CurrentUser(c)
 	if !ok {
-		fmt.Println("Error: obfuscated_id not found in session")
+		log.Print("Error: no user in session")
 		c.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
+	obfID := user.ObfID
 
-	// Connect to the database
-	db, err := db.ConnectToDatabase()
-	if err != nil {
-		log.Fatalf("Error connecting to DB in renderGame: %v", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	// get the users balance from the DB
-	var cashBalance float64
-	var solanaBalance float64
-	query := `
-		select cash_balance, solana_balance
-		from balance
-		where obfuscatedid = $1
-	`
-	err = db.QueryRow(query, obfID).Scan(&cashBalance, &solanaBalance)
+	// get the users balances from the DB
+	balances, err := books.Balances(c.Request.Context(), obfID)
 	if err != nil {
 		log.Print("Error fetching balance:", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	// every registered currency, including the ones the user holds nothing in
+	currencies := make([]gin.H, 0)
+	for _, cur := range currency.All() {
+		currencies = append(currencies, gin.H{
+			"Code": cur.Code,
+			"Name": cur.Name,
+			"Balance": cur.Display(balances[cur.Code]),
+			"PlayMoney": cur.PlayMoney,
+		})
+	}
+
+	betAmount := currency.Format(gs.BetCurrency, gs.BetAmount)
+	practice := false
+	if cur, ok := currency.Lookup(gs.BetCurrency); ok {
+		betAmount = cur.Display(gs.BetAmount)
+		practice = cur.PlayMoney
+	}
+
 	c.HTML(200, "blackjackgame.html", gin.H{
+		"Result": handResult(gs),
 		"Player": gs.Player,
 		"Dealer": gs.Dealer,
 		"PlayerScore": gs.Player.Score(),
 		"DealerScore": gs.Dealer.Score(),
 		"GameOver": gs.State == hand.StateHandOver,
 		"DealerHidden": gs.State == hand.StatePlayerTurn, // hide dealers 2nd card on player turn
-		"CashBalance": cashBalance,
-		"SolanaBalance": solanaBalance,
-		"BetAmount": gs.BetAmount,
-		"BetCurrency": gs.BetCurrency,
+		"Currencies": currencies,
+		"BetAmount": betAmount,
+		"Practice": practice, // betting play money, label the table
+		"GameID": c.Param("id"),
+		"Notice": tableStatus(c.Param("id")), // paused or closing by staff
+		"CSRFToken": session.CSRFToken(c), // sent by htmx on every request from the page
 	})
-}
\ No newline at end of file
+}
+// handResult is what the game page says about a finished hand, scored the
+// same way settleHand pays it
+func handResult(gs hand.GameState) string {
+	if gs.State != hand.StateHandOver {
+		return ""
+	}
+	switch gs.Outcome() {
+	case hand.OutcomeBlackjack:
+		return "Blackjack! You win 3:2!"
+	case hand.OutcomeWin:
+		if gs.Dealer.Score() > 21 {
+			return "Dealer busted! You win!"
+		}
+		return "You win!"
+	case hand.OutcomePush:
+		return "It's a draw!"
+	default:
+		if gs.Player.Score() > 21 {
+			return "You busted!"
+		}
+		return "You lose!"
+	}
+}
@@ -0,0 +1,2 @@
+drop table if exists balance;
+drop table if exists users;
@@ -0,0 +1,19 @@
+-- the tables the code assumed before the repo had a schema. if not exists so
+-- a database that was set up by hand adopts this as its first version
+create table if not exists users (
+	id bigserial primary key,
+	oauthid text not null,
+	email text,
+	provider text not null,
+	obfuscatedid text not null,
+	created_at timestamptz not null default now()
+);
+
+create index if not exists users_oauthid_idx on users (oauthid);
+create index if not exists users_email_idx on users (email);
+
+create table if not exists balance (
+	obfuscatedid text primary key,
+	cash_balance double precision default 0,
+	solana_balance double precision default 0
+);
@@ -0,0 +1,4 @@
+drop table hand_history;
+drop trigger ledger_entries_no_update on ledger_entries;
+drop function ledger_entries_immutable();
+drop table ledger_entries;
@@ -0,0 +1,40 @@
+-- journal of every balance change, two legs per transaction that sum to zero.
+-- amounts are in the currency's minor unit
+create table ledger_entries (
+	id bigserial primary key,
+	txid uuid not null,
+	account text not null,
+	currency text not null,
+	amount bigint not null,
+	kind text not null,
+	reference text not null default '',
+	created_at timestamptz not null default now()
+);
+
+create index ledger_entries_txid_idx on ledger_entries (txid);
+create index ledger_entries_account_idx on ledger_entries (account, currency);
+
+-- entries are immutable, mistakes are fixed with another posting
+create function ledger_entries_immutable() returns trigger as $$
+begin
+	raise exception 'ledger_entries are append only';
+end;
+$$ language plpgsql;
+
+create trigger ledger_entries_no_update
+	before update or delete on ledger_entries
+	for each row execute function ledger_entries_immutable();
+
+create table hand_history (
+	id bigserial primary key,
+	gameid text not null,
+	obfuscatedid text not null default '',
+	action text not null,
+	player_hand text not null default '',
+	dealer_hand text not null default '',
+	bet_amount bigint not null default 0,
+	bet_currency text not null default '',
+	created_at timestamptz not null default now()
+);
+
+create index hand_history_gameid_idx on hand_history (gameid);
@@ -0,0 +1,4 @@
+-- back to float dollars/SOL, only exact for amounts a float64 can hold
+alter table balance
+	alter column cash_balance type double precision using cash_balance / 100.0,
+	alter column solana_balance type double precision using solana_balance / 1000000000.0;
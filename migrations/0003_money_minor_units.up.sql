@@ -0,0 +1,7 @@
+-- balances move from float dollars/SOL to integer minor units: cents for
+-- cash, lamports (1e-9 SOL) for solana
+alter table balance
+	alter column cash_balance type bigint using round(coalesce(cash_balance, 0) * 100),
+	alter column solana_balance type bigint using round(coalesce(solana_balance, 0) * 1000000000),
+	alter column cash_balance set default 0,
+	alter column solana_balance set default 0;
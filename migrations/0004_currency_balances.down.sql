@@ -0,0 +1,21 @@
+-- back to one column per currency, balances in any other currency are lost
+create table balance (
+	obfuscatedid text primary key,
+	cash_balance bigint not null default 0,
+	solana_balance bigint not null default 0
+);
+
+insert into balance (obfuscatedid, cash_balance, solana_balance)
+select obfuscatedid,
+	coalesce(sum(amount) filter (where currency = 'cash'), 0),
+	coalesce(sum(amount) filter (where currency = 'solana'), 0)
+from balances
+group by obfuscatedid;
+
+drop table balances;
+
+-- the opening entries go with the balances they opened, so running up again
+-- doesn't open them twice
+alter table ledger_entries disable trigger ledger_entries_no_update;
+delete from ledger_entries where kind = 'opening';
+alter table ledger_entries enable trigger ledger_entries_no_update;
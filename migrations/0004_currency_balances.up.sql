@@ -0,0 +1,33 @@
+-- one balance row per (user, currency) instead of one column per currency,
+-- so a new currency in the registry needs no schema change
+create table balances (
+	obfuscatedid text not null,
+	currency text not null,
+	amount bigint not null default 0,
+	primary key (obfuscatedid, currency)
+);
+
+insert into balances (obfuscatedid, currency, amount)
+select obfuscatedid, 'cash', coalesce(cash_balance, 0) from balance
+union all
+select obfuscatedid, 'solana', coalesce(solana_balance, 0) from balance;
+
+drop table balance;
+
+-- balances from before the ledger have no journal entries behind them. open
+-- the journal with whatever part of each balance it doesn't already account
+-- for, paid in by the house, so reconcile agrees with the balances from here
+with openings as materialized (
+	select gen_random_uuid() as txid, obfuscatedid, currency, amount
+	from (
+		select b.obfuscatedid, b.currency, b.amount - coalesce(sum(e.amount), 0) as amount
+		from balances b
+		left join ledger_entries e on e.account = b.obfuscatedid and e.currency = b.currency
+		group by b.obfuscatedid, b.currency, b.amount
+	) unjournaled
+	where amount <> 0
+)
+insert into ledger_entries (txid, account, currency, amount, kind, reference)
+select txid, 'house', currency, -amount, 'opening', obfuscatedid from openings
+union all
+select txid, obfuscatedid, currency, amount, 'opening', 'house' from openings;
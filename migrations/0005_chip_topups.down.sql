@@ -0,0 +1 @@
+drop table chip_topups;
@@ -0,0 +1,5 @@
+-- last day each player's practice chips were refilled
+create table chip_topups (
+	obfuscatedid text primary key,
+	topped_up_on date not null
+);
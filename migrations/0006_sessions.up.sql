@@ -0,0 +1,13 @@
+-- server side sessions, the cookie only carries a token whose hash is the id
+create table sessions (
+	id text primary key,
+	userid text not null,
+	obfuscatedid text not null,
+	user_agent text not null default '',
+	ip text not null default '',
+	created_at timestamptz not null default now(),
+	last_seen timestamptz not null default now()
+);
+
+create index sessions_userid_idx on sessions (userid);
+create index sessions_last_seen_idx on sessions (last_seen);
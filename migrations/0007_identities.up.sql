@@ -0,0 +1,18 @@
+-- every provider login that reaches an account, so one obfuscatedid can be
+-- signed in to from several providers
+create table identities (
+	provider text not null,
+	provider_user_id text not null,
+	obfuscatedid text not null,
+	email text,
+	created_at timestamptz not null default now(),
+	primary key (provider, provider_user_id)
+);
+
+create index identities_obfuscatedid_idx on identities (obfuscatedid);
+
+-- every existing account keeps the login it signed up with
+insert into identities (provider, provider_user_id, obfuscatedid, email, created_at)
+select provider, oauthid, obfuscatedid, email, created_at
+from users
+on conflict do nothing;
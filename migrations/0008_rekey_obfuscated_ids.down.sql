@@ -0,0 +1,4 @@
+-- the new ids stay, there's no going back to ids that collide. this only
+-- drops the constraint and the mapping so the rekey can be run again
+drop index users_obfuscatedid_key;
+drop table obfid_rekeys;
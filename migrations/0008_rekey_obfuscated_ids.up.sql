@@ -0,0 +1,83 @@
+-- obfuscated ids used to be the first 8 hex characters of sha256(oauthid),
+-- short enough for two accounts to collide and share a balance. every account
+-- gets a new random 32 character id here and the ids become unique.
+-- collided accounts can't be told apart in the balances or the journal, so the
+-- oldest of them keeps the shared funds and history and the rest start empty.
+-- obfid_rekeys keeps the mapping, and the collisions, for support to review
+create table obfid_rekeys (
+	userid bigint primary key,
+	old_obfuscatedid text not null,
+	new_obfuscatedid text not null unique,
+	collided boolean not null,
+	kept_funds boolean not null,
+	rekeyed_at timestamptz not null default now()
+);
+
+insert into obfid_rekeys (userid, old_obfuscatedid, new_obfuscatedid, collided, kept_funds)
+select
+	id,
+	obfuscatedid,
+	replace(gen_random_uuid()::text, '-', ''),
+	count(*) over (partition by obfuscatedid) > 1,
+	row_number() over (partition by obfuscatedid order by created_at, id) = 1
+from users;
+
+-- the journal is append only, so the old id's entries stay where they are
+-- and whatever they add up to moves to the new id with a transfer between the
+-- two accounts, rather than by rewriting them. it's the journal's sum that
+-- moves, not the balance, so the old id nets to exactly zero and the new id's
+-- journal sums to what the old one's did. 0004 opened the journal with every
+-- balance from before the ledger, so that's the balance that moves with it
+-- below and reconcile stays clean
+with moves as materialized (
+	select gen_random_uuid() as txid, old_obfuscatedid, new_obfuscatedid, currency, amount
+	from (
+		select r.old_obfuscatedid, r.new_obfuscatedid, e.currency, sum(e.amount) as amount
+		from ledger_entries e
+		join obfid_rekeys r on r.old_obfuscatedid = e.account and r.kept_funds
+		group by r.old_obfuscatedid, r.new_obfuscatedid, e.currency
+	) held
+	where amount <> 0
+)
+insert into ledger_entries (txid, account, currency, amount, kind, reference)
+select txid, old_obfuscatedid, currency, -amount, 'rekey', new_obfuscatedid from moves
+union all
+select txid, new_obfuscatedid, currency, amount, 'rekey', old_obfuscatedid from moves;
+
+update balances b
+set obfuscatedid = r.new_obfuscatedid
+from obfid_rekeys r
+where r.old_obfuscatedid = b.obfuscatedid and r.kept_funds;
+
+update hand_history h
+set obfuscatedid = r.new_obfuscatedid
+from obfid_rekeys r
+where r.old_obfuscatedid = h.obfuscatedid and r.kept_funds;
+
+update chip_topups t
+set obfuscatedid = r.new_obfuscatedid
+from obfid_rekeys r
+where r.old_obfuscatedid = t.obfuscatedid and r.kept_funds;
+
+-- the login each account signed up with follows that account, anything
+-- linked later can only go to the account that kept the funds
+update identities i
+set obfuscatedid = r.new_obfuscatedid
+from users u
+join obfid_rekeys r on r.userid = u.id
+where i.provider = u.provider and i.provider_user_id = u.oauthid;
+
+update identities i
+set obfuscatedid = r.new_obfuscatedid
+from obfid_rekeys r
+where r.old_obfuscatedid = i.obfuscatedid and r.kept_funds;
+
+update users u
+set obfuscatedid = r.new_obfuscatedid
+from obfid_rekeys r
+where r.userid = u.id;
+
+-- sessions carry the old id, everyone signs in again
+delete from sessions;
+
+create unique index users_obfuscatedid_key on users (obfuscatedid);
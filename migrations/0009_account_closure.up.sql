@@ -0,0 +1,3 @@
+-- closed accounts keep their row so the ledger and hand history still point
+-- at an obfuscated id nobody else will ever get, with the personal data gone
+alter table users add column closed_at timestamptz;
@@ -0,0 +1,4 @@
+drop trigger admin_audit_no_update on admin_audit;
+drop function admin_audit_immutable();
+drop table admin_audit;
+alter table users drop column role;
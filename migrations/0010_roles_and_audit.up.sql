@@ -0,0 +1,25 @@
+-- staff accounts are ordinary accounts with a role above player
+alter table users add column role text not null default 'player'
+	check (role in ('player', 'support', 'admin'));
+
+-- everything staff do through /admin. Like the ledger it's append only
+create table admin_audit (
+	id bigserial primary key,
+	actor text not null,
+	action text not null,
+	target text not null default '',
+	detail text not null default '',
+	created_at timestamptz not null default now()
+);
+
+create index admin_audit_target_idx on admin_audit (target);
+
+create function admin_audit_immutable() returns trigger as $$
+begin
+	raise exception 'admin_audit is append only';
+end;
+$$ language plpgsql;
+
+create trigger admin_audit_no_update
+	before update or delete on admin_audit
+	for each row execute function admin_audit_immutable();
@@ -0,0 +1,3 @@
+drop trigger audit_log_no_update on audit_log;
+drop function audit_log_immutable();
+drop table audit_log;
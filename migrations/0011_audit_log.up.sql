@@ -0,0 +1,24 @@
+-- tamper evident audit log. seq is handed out by the app rather than a
+-- sequence, so a missing number always means a missing record
+create table audit_log (
+	seq bigint primary key check (seq > 0),
+	type text not null,
+	actor text not null,
+	subject text not null default '',
+	data text not null default '{}',
+	created_at timestamptz not null,
+	prev_hash text not null,
+	hash text not null unique
+);
+
+create index audit_log_subject_idx on audit_log (subject);
+
+create function audit_log_immutable() returns trigger as $$
+begin
+	raise exception 'audit_log is append only';
+end;
+$$ language plpgsql;
+
+create trigger audit_log_no_update
+	before update or delete or truncate on audit_log
+	for each statement execute function audit_log_immutable();
@@ -0,0 +1,17 @@
+-- every attempt to pay in, pending until the processor answers. The ledger
+-- is only credited when a deposit moves to confirmed
+create table deposits (
+	id text primary key,
+	obfuscatedid text not null,
+	method text not null,
+	currency text not null,
+	amount bigint not null check (amount > 0),
+	status text not null check (status in ('pending', 'confirmed', 'failed', 'refunded')),
+	card text not null default '',
+	authorization_id text not null default '',
+	failure_reason text not null default '',
+	created_at timestamptz not null default now(),
+	updated_at timestamptz not null default now()
+);
+
+create index deposits_obfuscatedid_idx on deposits (obfuscatedid, created_at);
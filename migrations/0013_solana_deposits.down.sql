@@ -0,0 +1,2 @@
+alter table deposits drop column tx_signature;
+alter table deposits drop column wallet;
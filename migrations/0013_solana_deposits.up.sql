@@ -0,0 +1,4 @@
+-- Solana deposits are checked on chain, and each transaction can only be
+-- credited once however many times its signature is sent in
+alter table deposits add column wallet text not null default '';
+alter table deposits add column tx_signature text unique;
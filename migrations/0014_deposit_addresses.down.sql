@@ -0,0 +1,3 @@
+drop index deposits_tx_signature_obfuscatedid_key;
+alter table deposits add constraint deposits_tx_signature_key unique (tx_signature);
+drop table deposit_addresses;
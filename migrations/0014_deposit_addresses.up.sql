@@ -0,0 +1,13 @@
+-- every player gets their own Solana address to deposit to, derived from
+-- the server's master key. cursor is how far the watcher has read
+create table deposit_addresses (
+	obfuscatedid text primary key,
+	address text not null unique,
+	cursor text not null default '',
+	created_at timestamptz not null default now()
+);
+
+-- one transaction can pay several players' addresses at once, so it's only
+-- unique per player now
+alter table deposits drop constraint deposits_tx_signature_key;
+create unique index deposits_tx_signature_obfuscatedid_key on deposits (tx_signature, obfuscatedid);
@@ -0,0 +1,4 @@
+-- fails while anything is still capturing, those have to be finished by hand
+alter table deposits drop constraint deposits_status_check;
+alter table deposits add constraint deposits_status_check
+	check (status in ('pending', 'confirmed', 'failed', 'refunded'));
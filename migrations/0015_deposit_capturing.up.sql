@@ -0,0 +1,5 @@
+-- a card deposit is claimed as capturing before the money is taken, so it
+-- never has to go back to pending once it might have been
+alter table deposits drop constraint deposits_status_check;
+alter table deposits add constraint deposits_status_check
+	check (status in ('pending', 'capturing', 'confirmed', 'failed', 'refunded'));
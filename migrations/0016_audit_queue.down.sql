@@ -0,0 +1,9 @@
+-- fails while anything is still queued, chain it first
+do $$
+begin
+	if exists (select 1 from audit_queue) then
+		raise exception 'audit_queue still has events in it';
+	end if;
+end
+$$;
+drop table audit_queue;
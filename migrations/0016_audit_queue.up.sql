@@ -0,0 +1,11 @@
+-- postings queue their audit events here instead of chaining them into
+-- audit_log themselves, which would mean holding the log's lock for the rest
+-- of the posting. They're moved into the log, in id order, soon after
+create table audit_queue (
+	id bigserial primary key,
+	type text not null,
+	actor text not null,
+	subject text not null default '',
+	data text not null default '{}',
+	created_at timestamptz not null
+);
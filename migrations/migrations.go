@@ -0,0 +1,385 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Scrimzay/loglogger"
+)
+
+var (
+	log *logger.Logger
+)
+
+func init() {
+	var err error
+	log, err = logger.New("migrationslog.txt")
+	if err != nil {
+		log.Fatalf("Failed to start new logger in migrations: %v", err)
+	}
+}
+
+// every schema change lives in this directory as NNNN_name.up.sql and
+// NNNN_name.down.sql and is compiled into the binary. A change that needs
+// the schema brings its numbered migration with it, never a loose SQL file
+// to run by hand
+//
+//go:embed *.sql
+var files embed.FS
+
+var filename = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// arbitrary key for pg_advisory_lock so two servers starting at once don't
+// both run the same migration
+const lockKey = 7212024
+
+// Migration is one versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration and whether it has been applied
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Load reads the embedded migrations in version order
+func Load() ([]Migration, error) {
+	entries, err := files.ReadDir(".")
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := filename.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("badly named migration: %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+
+		contents, err := files.ReadFile(entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %w", entry.Name(), err)
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(contents)
+		} else {
+			mig.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Up applies every migration newer than the database's current version,
+// each in its own transaction. It returns how many were applied
+func Up(db *sql.DB) (int, error) {
+	return upTo(db, math.MaxInt)
+}
+
+// upTo is Up stopping after version, for tests that need a database as it
+// was part way through its history
+func upTo(db *sql.DB, version int) (int, error) {
+	migrations, err := Load()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	err = withLock(db, func(conn *sql.Conn) error {
+		current, err := currentVersion(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range migrations {
+			if mig.Version <= current {
+				continue
+			}
+			if mig.Version > version {
+				break
+			}
+			err := inTx(conn, func(tx *sql.Tx) error {
+				if _, err := tx.Exec(mig.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(`
+					insert into schema_migrations
+					(version, name)
+					values ($1, $2)
+				`, mig.Version, mig.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("error applying migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			log.Printf("Applied migration %d_%s\n", mig.Version, mig.Name)
+			applied++
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down rolls back the newest steps migrations. It returns how many were rolled back
+func Down(db *sql.DB, steps int) (int, error) {
+	migrations, err := Load()
+	if err != nil {
+		return 0, err
+	}
+
+	rolledBack := 0
+	err = withLock(db, func(conn *sql.Conn) error {
+		current, err := currentVersion(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && rolledBack < steps; i-- {
+			mig := migrations[i]
+			if mig.Version > current {
+				continue
+			}
+			err := inTx(conn, func(tx *sql.Tx) error {
+				if _, err := tx.Exec(mig.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(`delete from schema_migrations where version = $1`, mig.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("error rolling back migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			log.Printf("Rolled back migration %d_%s\n", mig.Version, mig.Name)
+			rolledBack++
+		}
+		return nil
+	})
+
+	return rolledBack, err
+}
+
+// baselineChecks says, for each migration Baseline can mark, whether a
+// database already has what it would have done. Those are the ones whose SQL
+// went round as files run by hand before there was a runner, there's no
+// telling which of them a given database had run
+var baselineChecks = map[int]string{
+	1: `select to_regclass('users') is not null`,
+	2: `select to_regclass('ledger_entries') is not null
+		and to_regclass('hand_history') is not null
+		and exists (
+			select 1 from pg_trigger
+			where tgname = 'ledger_entries_no_update'
+			and tgrelid = to_regclass('ledger_entries')
+		)`,
+	// balance is gone once 0004 has been run
+	3: `select to_regclass('balances') is not null or exists (
+			select 1 from information_schema.columns
+			where table_schema = current_schema()
+			and table_name = 'balance' and column_name = 'cash_balance'
+			and data_type = 'bigint'
+		)`,
+	// the journal has to account for every balance, or reconcile never will
+	4: `select to_regclass('balances') is not null
+		and to_regclass('balance') is null
+		and not exists (
+			select 1 from balances b
+			left join ledger_entries e on e.account = b.obfuscatedid and e.currency = b.currency
+			group by b.obfuscatedid, b.currency, b.amount
+			having b.amount <> coalesce(sum(e.amount), 0)
+		)`,
+	5: `select to_regclass('chip_topups') is not null`,
+}
+
+// Baseline marks every migration up to and including version as applied
+// without running it, for a database whose schema was built by hand before
+// it had schema_migrations. Only migrations with a baseline check can be
+// marked, and each one's check has to pass first, so a database is never
+// marked as having something it doesn't. It refuses a database that has
+// already been migrated. It returns how many were marked
+func Baseline(db *sql.DB, version int) (int, error) {
+	migrations, err := Load()
+	if err != nil {
+		return 0, err
+	}
+	known := false
+	for _, mig := range migrations {
+		known = known || mig.Version == version
+	}
+	if !known {
+		return 0, fmt.Errorf("no migration %d to baseline at", version)
+	}
+	if _, ok := baselineChecks[version]; !ok {
+		return 0, fmt.Errorf("migration %d was never run by hand, apply it with migrate up", version)
+	}
+
+	marked := 0
+	err = withLock(db, func(conn *sql.Conn) error {
+		current, err := currentVersion(conn)
+		if err != nil {
+			return err
+		}
+		if current != 0 {
+			return fmt.Errorf("database is already at version %d", current)
+		}
+
+		return inTx(conn, func(tx *sql.Tx) error {
+			for _, mig := range migrations {
+				if mig.Version > version {
+					break
+				}
+				var done bool
+				if err := tx.QueryRow(baselineChecks[mig.Version]).Scan(&done); err != nil {
+					return fmt.Errorf("error checking migration %d_%s: %w", mig.Version, mig.Name, err)
+				}
+				if !done {
+					return fmt.Errorf("database doesn't have what migration %d_%s makes, it can't be baselined there", mig.Version, mig.Name)
+				}
+				_, err := tx.Exec(`
+					insert into schema_migrations
+					(version, name)
+					values ($1, $2)
+				`, mig.Version, mig.Name)
+				if err != nil {
+					return fmt.Errorf("error marking migration %d_%s: %w", mig.Version, mig.Name, err)
+				}
+				marked++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Baselined database at migration %d\n", version)
+	return marked, nil
+}
+
+// List returns every migration and when it was applied, if it was
+func List(db *sql.DB) ([]Status, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	appliedAt := make(map[int]time.Time)
+	err = withLock(db, func(conn *sql.Conn) error {
+		rows, err := conn.QueryContext(context.Background(), `select version, applied_at from schema_migrations`)
+		if err != nil {
+			return fmt.Errorf("error reading schema_migrations: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var at time.Time
+			if err := rows.Scan(&version, &at); err != nil {
+				return fmt.Errorf("error scanning schema_migrations: %w", err)
+			}
+			appliedAt[version] = at
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(migrations))
+	for _, mig := range migrations {
+		s := Status{Migration: mig}
+		if at, ok := appliedAt[mig.Version]; ok {
+			s.AppliedAt = &at
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// withLock runs fn on a single connection holding the migrations advisory
+// lock, creating the schema_migrations table first if it isn't there
+func withLock(db *sql.DB, fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting connection for migrations: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `select pg_advisory_lock($1)`, lockKey); err != nil {
+		return fmt.Errorf("error taking migrations lock: %w", err)
+	}
+	// #nosec G104 -- the lock goes with the connection anyway
+	defer conn.ExecContext(ctx, `select pg_advisory_unlock($1)`, lockKey)
+
+	_, err = conn.ExecContext(ctx, `
+		create table if not exists schema_migrations (
+			version integer primary key,
+			name text not null,
+			applied_at timestamptz not null default now()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+
+	return fn(conn)
+}
+
+func currentVersion(conn *sql.Conn) (int, error) {
+	var version int
+	err := conn.QueryRowContext(context.Background(), `
+		select coalesce(max(version), 0)
+		from schema_migrations
+	`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("error reading schema version: %w", err)
+	}
+	return version, nil
+}
+
+func inTx(conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	// #nosec G104 -- rollback after commit is a no-op
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
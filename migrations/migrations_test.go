@@ -0,0 +1,174 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/db"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/google/uuid"
+)
+
+// scratchDB opens the database in TEST_DATABASE_URL on a schema of its own,
+// empty and dropped again after the test, so every migration runs from the
+// start whatever else the database has been used for
+func scratchDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	cfg := config.DB{DSN: dsn, MaxOpenConns: 2, MaxIdleConns: 2, ConnMaxLifetime: time.Minute}
+
+	admin, err := db.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if _, err := admin.Exec("create schema " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("drop schema " + schema + " cascade"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// lib/pq hands search_path to the server for every connection it opens
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		cfg.DSN = u.String()
+	} else {
+		cfg.DSN = dsn + " search_path=" + schema
+	}
+	database, err := db.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+// TestRekeyReconciles builds a database as it was before the ledger, with
+// two accounts that collided on one obfuscated id, and migrates it the rest
+// of the way. The journal has to agree with every balance afterwards, and
+// the funds have to have followed the account that kept them
+func TestRekeyReconciles(t *testing.T) {
+	database := scratchDB(t)
+	ctx := context.Background()
+
+	// the ledger tables are there, but the balances are still one column
+	// per currency
+	if _, err := upTo(database, 3); err != nil {
+		t.Fatal(err)
+	}
+	_, err := database.Exec(`
+		insert into users (oauthid, email, provider, obfuscatedid, created_at) values
+			('alice', 'alice@example.com', 'google', 'aaaa1111', now() - interval '2 days'),
+			('bob', 'bob@example.com', 'google', 'aaaa1111', now() - interval '1 day'),
+			('carol', 'carol@example.com', 'google', 'cccc3333', now());
+
+		insert into balance (obfuscatedid, cash_balance, solana_balance) values
+			('aaaa1111', 1234, 500000000),
+			('cccc3333', 700, 0);
+
+		-- carol won 2.00 after the ledger went in, the rest of her balance
+		-- is from before it
+		insert into ledger_entries (txid, account, currency, amount, kind, reference) values
+			('6f1c1a3e-0b0e-4c55-9d5e-0d8c0f6f4a01', 'house', 'cash', -200, 'payout', 'g1'),
+			('6f1c1a3e-0b0e-4c55-9d5e-0d8c0f6f4a01', 'cccc3333', 'cash', 200, 'payout', 'g1');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Up(database); err != nil {
+		t.Fatal(err)
+	}
+
+	books := ledger.New(repo.NewPostgres(database).Balances)
+	report, err := books.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("ledger doesn't reconcile after the rekey: %+v", report)
+	}
+
+	for _, want := range []struct {
+		oauthID  string
+		balances map[string]money.Amount
+	}{
+		// alice signed up first, she keeps what the shared id held
+		{"alice", map[string]money.Amount{"cash": 1234, "solana": 500000000}},
+		{"bob", map[string]money.Amount{}},
+		{"carol", map[string]money.Amount{"cash": 700}},
+	} {
+		var obfID string
+		if err := database.QueryRow(`select obfuscatedid from users where oauthid = $1`, want.oauthID).Scan(&obfID); err != nil {
+			t.Fatal(err)
+		}
+		if obfID == "aaaa1111" || obfID == "cccc3333" {
+			t.Fatalf("%s wasn't rekeyed", want.oauthID)
+		}
+		balances, err := books.Balances(ctx, obfID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for currency, amount := range want.balances {
+			if balances[currency] != amount {
+				t.Errorf("%s has %d %s, want %d", want.oauthID, balances[currency], currency, amount)
+			}
+		}
+		for currency, amount := range balances {
+			if _, ok := want.balances[currency]; !ok && amount != 0 {
+				t.Errorf("%s has %d %s, want none", want.oauthID, amount, currency)
+			}
+		}
+	}
+}
+
+// TestBaselineChecks builds a database the way the hand run files did, but
+// without the journal's immutability trigger. Baseline must mark it as far
+// as it goes and no further
+func TestBaselineChecks(t *testing.T) {
+	database := scratchDB(t)
+
+	migrations, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mig := range migrations[:2] {
+		if _, err := database.Exec(mig.Up); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := database.Exec(`drop trigger ledger_entries_no_update on ledger_entries`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Baseline(database, 2); err == nil {
+		t.Fatal("baselined at 2 without the immutability trigger")
+	}
+	marked, err := Baseline(database, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marked != 1 {
+		t.Fatalf("%d migrations marked, want 1", marked)
+	}
+	if _, err := Baseline(database, 5); err == nil {
+		t.Fatal("baselined a database that was already migrated")
+	}
+}
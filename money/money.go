@@ -0,0 +1,80 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Amount is an exact amount of money in a currency's minor unit, cents for
+// cash and lamports for solana. Never convert it to a float to do maths on it
+type Amount int64
+
+// Parse turns a decimal string like "12.50" into minor units of a currency
+// with d decimal places. It refuses negative amounts and more decimal places
+// than the currency has rather than rounding them away
+func Parse(d int, s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("amount is empty")
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if !isDigits(whole) || (frac != "" && !isDigits(frac)) {
+		return 0, fmt.Errorf("invalid amount: %q", s)
+	}
+	if len(frac) > d {
+		return 0, fmt.Errorf("invalid amount: %q has more than %d decimal places", s, d)
+	}
+
+	// pad the fraction out to the minor unit, "12.5" cash is 1250 cents
+	frac += strings.Repeat("0", d-len(frac))
+	n, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount: %q is out of range", s)
+	}
+
+	return Amount(n), nil
+}
+
+// Format turns minor units of a currency with d decimal places back into a
+// decimal string, keeping at least two decimal places so "1.50" doesn't show
+// up as "1.5" or "1.500000000"
+func Format(d int, a Amount) string {
+	sign := ""
+	n := uint64(a)
+	if a < 0 {
+		sign = "-"
+		n = uint64(-a)
+	}
+
+	s := strconv.FormatUint(n, 10)
+	if d == 0 {
+		return sign + s
+	}
+	if len(s) <= d {
+		s = strings.Repeat("0", d-len(s)+1) + s
+	}
+
+	whole, frac := s[:len(s)-d], s[len(s)-d:]
+	keep := min(2, d)
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) < keep {
+		frac += strings.Repeat("0", keep-len(frac))
+	}
+
+	return sign + whole + "." + frac
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
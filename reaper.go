@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/hand"
+	"github.com/Scrimzay/blackjackgame/history"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/repo"
+)
+
+// reaper expires idle tables, refunding through the ledger and writing
+// what it did to the hand history
+type reaper struct {
+	cfg   config.Tables
+	books *ledger.Ledger
+	games repo.GameRepo
+}
+
+// startReaper sweeps the games map in the background and expires tables
+// that nobody has touched for longer than the TTL
+func startReaper(cfg config.Tables, books *ledger.Ledger, games repo.GameRepo) {
+	rp := &reaper{cfg: cfg, books: books, games: games}
+
+	interval := cfg.IdleTTL / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			rp.reapIdleGames(now)
+		}
+	}()
+}
+
+func (rp *reaper) reapIdleGames(now time.Time) {
+	expired := make(map[string]*hand.GameState)
+
+	// only hold the locks long enough to pull the tables out of the map,
+	// the refunds and history writes go to the DB
+	gamesMu.Lock()
+	for id, t := range games {
+		t.mu.Lock()
+		if now.Sub(t.gs.LastActive) > rp.cfg.IdleTTL {
+			t.closed = true
+			expired[id] = t.gs
+			delete(games, id)
+		}
+		t.mu.Unlock()
+	}
+	gamesMu.Unlock()
+
+	ctx := context.Background()
+	for id, gs := range expired {
+		if err := rp.expireGame(ctx, id, gs); err != nil {
+			log.Printf("Error expiring game %s: %v", id, err)
+		}
+	}
+}
+
+func (rp *reaper) expireGame(ctx context.Context, gameID string, gs *hand.GameState) error {
+	action := history.ActionExpired
+
+	if gs.BetInProgress() {
+		// nothing to stand on if the cards were never dealt
+		if rp.cfg.ExpiryPolicy == config.ExpiryStand && gs.State == hand.StatePlayerTurn {
+			// the table is out of the map already, nobody else can touch it
+			*gs = hand.Stand(*gs)
+			if _, err := settleHand(ctx, rp.books, gameID, *gs); err != nil {
+				return err
+			}
+			action = history.ActionExpiredStand
+		} else {
+			if err := rp.refundBet(ctx, gameID, gs); err != nil {
+				return err
+			}
+			action = history.ActionExpiredRefund
+		}
+	}
+
+	log.Printf("Expired game %s (%s)", gameID, action)
+
+	return history.Record(ctx, rp.games, history.Entry{
+		GameID:      gameID,
+		ObfID:       gs.Owner,
+		Action:      action,
+		Player:      gs.Player.String(),
+		Dealer:      gs.Dealer.String(),
+		BetAmount:   gs.BetAmount,
+		BetCurrency: gs.BetCurrency,
+	})
+}
+
+func (rp *reaper) refundBet(ctx context.Context, gameID string, gs *hand.GameState) error {
+	_, err := rp.books.Record(ctx, ledger.KindRefund, gs.Owner, gs.BetCurrency, gs.BetAmount, gameID)
+	if err != nil {
+		return fmt.Errorf("error refunding bet: %w", err)
+	}
+
+	log.Printf("Refunded bet: obfID=%s, amount=%s %s", gs.Owner, currency.Format(gs.BetCurrency, gs.BetAmount), gs.BetCurrency)
+	return nil
+}
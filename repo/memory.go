@@ -0,0 +1,759 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/google/uuid"
+)
+
+// NewMemory builds every repository in process memory, for running the
+// server and tests on a laptop with no Postgres. Everything is gone when the
+// process exits
+func NewMemory() *Repos {
+	events := &memEvents{}
+	balances := &memBalances{events: events}
+	deposits := &memDeposits{balances: balances}
+	users := &memUsers{deposits: deposits}
+	return &Repos{
+		Users:     users,
+		Balances:  balances,
+		Games:     &memGames{},
+		Sessions:  &memSessions{},
+		Audit:     &memAudit{},
+		Events:    events,
+		Deposits:  deposits,
+		Addresses: &memAddresses{users: users},
+	}
+}
+
+type memUsers struct {
+	deposits *memDeposits // for the in flight check on Close
+
+	mu         sync.Mutex
+	users      []User
+	identities []Identity
+	nextID     int64
+}
+
+func (r *memUsers) CountByEmail(ctx context.Context, email string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for _, u := range r.users {
+		if u.Email == email {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *memUsers) FindByOAuthID(ctx context.Context, oauthID string) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.OAuthID == oauthID {
+			return u, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (r *memUsers) FindByObfID(ctx context.Context, obfID string) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.ObfID == obfID {
+			return u, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (r *memUsers) List(ctx context.Context, search string, limit int) ([]User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	search = strings.ToLower(search)
+	var users []User
+	// newest first, like the Postgres version
+	for i := len(r.users) - 1; i >= 0 && len(users) < limit; i-- {
+		u := r.users[i]
+		if search == "" || strings.Contains(u.ObfID, search) || strings.Contains(strings.ToLower(u.Email), search) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (r *memUsers) SetRole(ctx context.Context, obfID, role string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, u := range r.users {
+		if u.ObfID == obfID {
+			r.users[i].Role = role
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memUsers) Create(ctx context.Context, u User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// same as the unique index on users.obfuscatedid
+	for _, existing := range r.users {
+		if existing.ObfID == u.ObfID {
+			return fmt.Errorf("error inserting user: obfuscated id %s already in use", u.ObfID)
+		}
+	}
+	r.nextID++
+	u.ID = r.nextID
+	u.CreatedAt = time.Now()
+	if u.Role == "" {
+		u.Role = "player"
+	}
+	r.users = append(r.users, u)
+	r.identities = append(r.identities, Identity{
+		Provider:       u.Provider,
+		ProviderUserID: u.OAuthID,
+		ObfID:          u.ObfID,
+		Email:          u.Email,
+		CreatedAt:      u.CreatedAt,
+	})
+	return nil
+}
+
+func (r *memUsers) Close(ctx context.Context, obfID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := false
+	for _, u := range r.users {
+		found = found || (u.ObfID == obfID && !u.Closed())
+	}
+	if !found {
+		return ErrNotFound
+	}
+
+	// held until the account is closed, so no deposit changes under it
+	r.deposits.mu.Lock()
+	defer r.deposits.mu.Unlock()
+	for _, d := range r.deposits.deposits {
+		// the same statuses as deposit.InFlight
+		if d.ObfID == obfID && (d.Status == "pending" || d.Status == "capturing") {
+			return ErrAccountBusy
+		}
+	}
+
+	now := time.Now()
+	for i, u := range r.users {
+		if u.ObfID == obfID && !u.Closed() {
+			r.users[i].Email = ""
+			r.users[i].OAuthID = "closed-" + obfID
+			r.users[i].ClosedAt = &now
+		}
+	}
+
+	kept := r.identities[:0]
+	for _, id := range r.identities {
+		if id.ObfID != obfID {
+			kept = append(kept, id)
+		}
+	}
+	r.identities = kept
+	return nil
+}
+
+func (r *memUsers) FindIdentity(ctx context.Context, provider, providerUserID string) (Identity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range r.identities {
+		if id.Provider == provider && id.ProviderUserID == providerUserID {
+			return id, nil
+		}
+	}
+	return Identity{}, ErrNotFound
+}
+
+func (r *memUsers) LinkIdentity(ctx context.Context, id Identity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.identities {
+		if existing.Provider == id.Provider && existing.ProviderUserID == id.ProviderUserID {
+			if existing.ObfID != id.ObfID {
+				return ErrAlreadyLinked
+			}
+			return nil
+		}
+	}
+	id.CreatedAt = time.Now()
+	r.identities = append(r.identities, id)
+	return nil
+}
+
+func (r *memUsers) ListIdentities(ctx context.Context, obfID string) ([]Identity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var identities []Identity
+	for _, id := range r.identities {
+		if id.ObfID == obfID {
+			identities = append(identities, id)
+		}
+	}
+	return identities, nil
+}
+
+func (r *memUsers) UnlinkIdentity(ctx context.Context, obfID, provider, providerUserID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count, found := 0, -1
+	for i, id := range r.identities {
+		if id.ObfID != obfID {
+			continue
+		}
+		count++
+		if id.Provider == provider && id.ProviderUserID == providerUserID {
+			found = i
+		}
+	}
+	if found < 0 {
+		return ErrNotFound
+	}
+	if count <= 1 {
+		return ErrLastIdentity
+	}
+	r.identities = append(r.identities[:found], r.identities[found+1:]...)
+	return nil
+}
+
+// memEntry is one leg of a journal transaction
+type memEntry struct {
+	txID      string
+	account   string
+	currency  string
+	amount    money.Amount
+	kind      string
+	reference string
+	createdAt time.Time
+}
+
+// memBalances holds one lock across the journal and the balances, which
+// gives the same all-or-nothing behaviour as the Postgres transaction
+type memBalances struct {
+	events *memEvents // for the postings' audit events
+
+	mu       sync.Mutex
+	journal  []memEntry
+	balances map[string]map[string]money.Amount
+	toppedUp map[string]string // obfID -> day of the last top up
+}
+
+func (r *memBalances) Post(ctx context.Context, p Posting) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.post(ctx, p)
+}
+
+func (r *memBalances) TopUp(ctx context.Context, p Posting, allowance money.Amount) (money.Amount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.toppedUp == nil {
+		r.toppedUp = make(map[string]string)
+	}
+	today := time.Now().Format("2006-01-02")
+	if r.toppedUp[p.ObfID] == today {
+		return 0, nil
+	}
+
+	balance := r.balances[p.ObfID][p.Currency]
+	if balance >= allowance {
+		r.toppedUp[p.ObfID] = today
+		return 0, nil
+	}
+	p.Amount = allowance - balance
+	if _, err := r.post(ctx, p); err != nil {
+		return 0, err
+	}
+	r.toppedUp[p.ObfID] = today
+	return p.Amount, nil
+}
+
+func (r *memBalances) Balances(ctx context.Context, obfID string) (map[string]money.Amount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	balances := make(map[string]money.Amount)
+	for currency, amount := range r.balances[obfID] {
+		balances[currency] = amount
+	}
+	return balances, nil
+}
+
+func (r *memBalances) AllBalances(ctx context.Context) (map[string]map[string]money.Amount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all := make(map[string]map[string]money.Amount)
+	for obfID, held := range r.balances {
+		all[obfID] = make(map[string]money.Amount)
+		for currency, amount := range held {
+			all[obfID][currency] = amount
+		}
+	}
+	return all, nil
+}
+
+func (r *memBalances) JournalSums(ctx context.Context) (map[string]map[string]money.Amount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sums := make(map[string]map[string]money.Amount)
+	for _, e := range r.journal {
+		if e.account == HouseAccount {
+			continue
+		}
+		if sums[e.account] == nil {
+			sums[e.account] = make(map[string]money.Amount)
+		}
+		sums[e.account][e.currency] += e.amount
+	}
+	return sums, nil
+}
+
+func (r *memBalances) UnbalancedTransactions(ctx context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	type key struct{ txID, currency string }
+	sums := make(map[key]money.Amount)
+	for _, e := range r.journal {
+		sums[key{e.txID, e.currency}] += e.amount
+	}
+	var txIDs []string
+	for k, sum := range sums {
+		if sum != 0 {
+			txIDs = append(txIDs, k.txID)
+		}
+	}
+	return txIDs, nil
+}
+
+func (r *memBalances) TopBalances(ctx context.Context, currency string, limit int) ([]Standing, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var standings []Standing
+	for obfID, held := range r.balances {
+		if amount, ok := held[currency]; ok {
+			standings = append(standings, Standing{ObfID: obfID, Amount: amount})
+		}
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		if standings[i].Amount != standings[j].Amount {
+			return standings[i].Amount > standings[j].Amount
+		}
+		return standings[i].ObfID < standings[j].ObfID
+	})
+	if len(standings) > limit {
+		standings = standings[:limit]
+	}
+	return standings, nil
+}
+
+func (r *memBalances) Journal(ctx context.Context, obfID string) ([]JournalEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var entries []JournalEntry
+	for _, e := range r.journal {
+		if e.account == obfID {
+			entries = append(entries, JournalEntry{
+				TxID:      e.txID,
+				Currency:  e.currency,
+				Amount:    e.amount,
+				Kind:      e.kind,
+				Reference: e.reference,
+				CreatedAt: e.createdAt,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// post is the in-memory version of the Postgres post, the caller holds r.mu
+func (r *memBalances) post(ctx context.Context, p Posting) (string, error) {
+	if r.balances == nil {
+		r.balances = make(map[string]map[string]money.Amount)
+	}
+	if r.balances[p.ObfID] == nil {
+		r.balances[p.ObfID] = make(map[string]money.Amount)
+	}
+
+	balance := r.balances[p.ObfID][p.Currency]
+	if p.Amount < 0 && balance < -p.Amount {
+		return "", ErrInsufficientFunds
+	}
+
+	// the audit event is queued first, nothing below can fail, so the
+	// posting is never there without it
+	txID := uuid.NewString()
+	if p.Audit != nil {
+		e, err := p.Audit(p, txID)
+		if err != nil {
+			return "", err
+		}
+		r.events.queue(e)
+	}
+
+	r.balances[p.ObfID][p.Currency] = balance + p.Amount
+	now := time.Now()
+	r.journal = append(r.journal,
+		memEntry{txID, p.ObfID, p.Currency, p.Amount, p.Kind, p.Reference, now},
+		memEntry{txID, HouseAccount, p.Currency, -p.Amount, p.Kind, p.Reference, now},
+	)
+	return txID, nil
+}
+
+type memGames struct {
+	mu      sync.Mutex
+	history []HistoryEntry
+}
+
+func (r *memGames) History(ctx context.Context, obfID string) ([]HistoryEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var history []HistoryEntry
+	for _, e := range r.history {
+		if e.ObfID == obfID {
+			history = append(history, e)
+		}
+	}
+	return history, nil
+}
+
+func (r *memGames) RecordHistory(ctx context.Context, e HistoryEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	r.history = append(r.history, e)
+	return nil
+}
+
+type memSessions struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func (r *memSessions) Create(ctx context.Context, s Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions == nil {
+		r.sessions = make(map[string]Session)
+	}
+	r.sessions[s.ID] = s
+	return nil
+}
+
+func (r *memSessions) Find(ctx context.Context, id string) (Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (r *memSessions) Touch(ctx context.Context, id string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.sessions[id]; ok {
+		s.LastSeen = at
+		r.sessions[id] = s
+	}
+	return nil
+}
+
+func (r *memSessions) Delete(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+	return nil
+}
+
+func (r *memSessions) ListByUser(ctx context.Context, userID string) ([]Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sessions []Session
+	for _, s := range r.sessions {
+		if s.UserID == userID {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+func (r *memSessions) DeleteByUser(ctx context.Context, userID string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deleted := 0
+	for id, s := range r.sessions {
+		if s.UserID == userID {
+			delete(r.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (r *memSessions) DeleteExpired(ctx context.Context, idleBefore, createdBefore time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deleted := 0
+	for id, s := range r.sessions {
+		if s.LastSeen.Before(idleBefore) || s.CreatedAt.Before(createdBefore) {
+			delete(r.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+type memAudit struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (r *memAudit) Append(ctx context.Context, e AuditEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.ID = int64(len(r.entries) + 1)
+	e.CreatedAt = time.Now()
+	r.entries = append(r.entries, e)
+	return nil
+}
+
+func (r *memAudit) List(ctx context.Context, limit int) ([]AuditEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var entries []AuditEntry
+	for i := len(r.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, r.entries[i])
+	}
+	return entries, nil
+}
+
+type memEvents struct {
+	mu     sync.Mutex
+	events []Event
+	queued []Event // from postings, waiting for Chain
+}
+
+func (r *memEvents) queue(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queued = append(r.queued, e)
+}
+
+func (r *memEvents) Chain(ctx context.Context, link func(e, last Event) Event) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.queued {
+		var last Event
+		if len(r.events) > 0 {
+			last = r.events[len(r.events)-1]
+		}
+		r.events = append(r.events, link(e, last))
+	}
+	chained := len(r.queued)
+	r.queued = nil
+	return chained, nil
+}
+
+func (r *memEvents) Append(ctx context.Context, seal func(last Event) (Event, error)) (Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var last Event
+	if len(r.events) > 0 {
+		last = r.events[len(r.events)-1]
+	}
+	e, err := seal(last)
+	if err != nil {
+		return e, err
+	}
+	r.events = append(r.events, e)
+	return e, nil
+}
+
+func (r *memEvents) Events(ctx context.Context, afterSeq int64, limit int) ([]Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []Event
+	for _, e := range r.events {
+		if e.Seq > afterSeq && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+type memDeposits struct {
+	balances *memBalances // for the credits that go with a deposit
+
+	mu       sync.Mutex
+	deposits []Deposit
+}
+
+func (r *memDeposits) Create(ctx context.Context, d Deposit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.deposits {
+		if existing.ID == d.ID || (d.TxSignature != "" && existing.TxSignature == d.TxSignature && existing.ObfID == d.ObfID) {
+			return ErrDuplicate
+		}
+	}
+	d.CreatedAt = time.Now()
+	d.UpdatedAt = d.CreatedAt
+	r.deposits = append(r.deposits, d)
+	return nil
+}
+
+func (r *memDeposits) Find(ctx context.Context, id string) (Deposit, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.deposits {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return Deposit{}, ErrNotFound
+}
+
+func (r *memDeposits) SetAuthorization(ctx context.Context, id, authorizationID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.deposits {
+		if r.deposits[i].ID == id {
+			r.deposits[i].AuthorizationID = authorizationID
+			r.deposits[i].UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memDeposits) Transition(ctx context.Context, id, from, to, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.deposits {
+		if r.deposits[i].ID == id && r.deposits[i].Status == from {
+			r.deposits[i].Status = to
+			r.deposits[i].FailureReason = reason
+			r.deposits[i].UpdatedAt = time.Now()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memDeposits) Credit(ctx context.Context, id, from, to, reason string, p Posting) (string, error) {
+	// both locks at once, nobody sees the status without the credit. Always
+	// deposits before balances
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.balances.mu.Lock()
+	defer r.balances.mu.Unlock()
+
+	for i := range r.deposits {
+		if r.deposits[i].ID == id && r.deposits[i].Status == from {
+			txID, err := r.balances.post(ctx, p)
+			if err != nil {
+				return "", err
+			}
+			r.deposits[i].Status = to
+			r.deposits[i].FailureReason = reason
+			r.deposits[i].UpdatedAt = time.Now()
+			return txID, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (r *memDeposits) ListByUser(ctx context.Context, obfID string) ([]Deposit, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deposits []Deposit
+	for i := len(r.deposits) - 1; i >= 0; i-- {
+		if r.deposits[i].ObfID == obfID {
+			deposits = append(deposits, r.deposits[i])
+		}
+	}
+	return deposits, nil
+}
+
+func (r *memDeposits) ListPending(ctx context.Context, method string) ([]Deposit, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deposits []Deposit
+	for _, d := range r.deposits {
+		if d.Status == "pending" && d.Method == method {
+			deposits = append(deposits, d)
+		}
+	}
+	return deposits, nil
+}
+
+type memAddresses struct {
+	users *memUsers // to leave out closed accounts, like the join in Postgres
+
+	mu        sync.Mutex
+	addresses []DepositAddress
+}
+
+func (r *memAddresses) Issue(ctx context.Context, obfID, address string) (DepositAddress, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the player's own address first, like the Postgres insert that does
+	// nothing on conflict and then looks it up
+	for _, a := range r.addresses {
+		if a.ObfID == obfID {
+			return a, nil
+		}
+	}
+	for _, a := range r.addresses {
+		if a.Address == address {
+			return DepositAddress{}, ErrDuplicate
+		}
+	}
+	a := DepositAddress{ObfID: obfID, Address: address, CreatedAt: time.Now()}
+	r.addresses = append(r.addresses, a)
+	return a, nil
+}
+
+func (r *memAddresses) List(ctx context.Context) ([]DepositAddress, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var addresses []DepositAddress
+	for _, a := range r.addresses {
+		if u, err := r.users.FindByObfID(ctx, a.ObfID); err == nil && !u.Closed() {
+			addresses = append(addresses, a)
+		}
+	}
+	return addresses, nil
+}
+
+func (r *memAddresses) SetCursor(ctx context.Context, obfID, signature string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.addresses {
+		if r.addresses[i].ObfID == obfID {
+			r.addresses[i].Cursor = signature
+			return nil
+		}
+	}
+	return ErrNotFound
+}
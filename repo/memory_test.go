@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAddressesIssue(t *testing.T) {
+	ctx := context.Background()
+	addresses := NewMemory().Addresses
+
+	a, err := addresses.Issue(ctx, "alice", "addr1")
+	if err != nil || a.Address != "addr1" {
+		t.Fatalf("first issue = %+v, %v", a, err)
+	}
+
+	// someone else's address is refused
+	if _, err := addresses.Issue(ctx, "bob", "addr1"); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("issuing alice's address to bob: err = %v, want ErrDuplicate", err)
+	}
+
+	b, err := addresses.Issue(ctx, "bob", "addr2")
+	if err != nil || b.Address != "addr2" {
+		t.Fatalf("bob's issue = %+v, %v", b, err)
+	}
+
+	// a player who already has an address gets it back, even when the one
+	// asked for collides with an address issued before theirs
+	again, err := addresses.Issue(ctx, "bob", "addr1")
+	if err != nil || again.Address != "addr2" {
+		t.Fatalf("bob's second issue = %+v, %v, want addr2", again, err)
+	}
+}
+
+// TestDepositCredit races credits for one deposit. Only one gets to post, and
+// a posting that fails leaves the deposit where it was
+func TestDepositCredit(t *testing.T) {
+	ctx := context.Background()
+	repos := NewMemory()
+	if err := repos.Deposits.Create(ctx, Deposit{ID: "dep_1", ObfID: "alice", Currency: "cash", Amount: 500, Status: "pending"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a debit the balance can't cover, the deposit stays pending
+	overdraw := Posting{Kind: "chargeback", ObfID: "alice", Currency: "cash", Amount: -500}
+	if _, err := repos.Deposits.Credit(ctx, "dep_1", "pending", "confirmed", "", overdraw); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("overdrawing credit: err = %v, want ErrInsufficientFunds", err)
+	}
+	if d, _ := repos.Deposits.Find(ctx, "dep_1"); d.Status != "pending" {
+		t.Fatalf("deposit is %s after a failed posting, want pending", d.Status)
+	}
+
+	credit := Posting{Kind: "deposit", ObfID: "alice", Currency: "cash", Amount: 500}
+	var credited atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := repos.Deposits.Credit(ctx, "dep_1", "pending", "confirmed", "", credit)
+			switch {
+			case err == nil:
+				credited.Add(1)
+			case !errors.Is(err, ErrNotFound):
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if credited.Load() != 1 {
+		t.Fatalf("deposit credited %d times, want 1", credited.Load())
+	}
+	if d, _ := repos.Deposits.Find(ctx, "dep_1"); d.Status != "confirmed" {
+		t.Fatalf("deposit is %s, want confirmed", d.Status)
+	}
+	journal, err := repos.Balances.Journal(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balances, _ := repos.Balances.Balances(ctx, "alice"); balances["cash"] != 500 || len(journal) != 1 {
+		t.Fatalf("balance is %d with %d journal entries, want 500 with 1", balances["cash"], len(journal))
+	}
+}
+
+// TestCloseWithDepositInFlight checks an account can't close while money is
+// still on its way in, and can once it's landed
+func TestCloseWithDepositInFlight(t *testing.T) {
+	ctx := context.Background()
+	repos := NewMemory()
+	if err := repos.Users.Create(ctx, User{OAuthID: "alice", Provider: "dev", ObfID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Deposits.Create(ctx, Deposit{ID: "dep_1", ObfID: "alice", Currency: "cash", Amount: 500, Status: "capturing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repos.Users.Close(ctx, "alice"); !errors.Is(err, ErrAccountBusy) {
+		t.Fatalf("closing with a deposit capturing: err = %v, want ErrAccountBusy", err)
+	}
+	if u, _ := repos.Users.FindByObfID(ctx, "alice"); u.Closed() {
+		t.Fatal("account closed with a deposit capturing")
+	}
+
+	if err := repos.Deposits.Transition(ctx, "dep_1", "capturing", "failed", "declined"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Users.Close(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := repos.Users.FindByObfID(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.Closed() || u.ClosedAt == nil {
+		t.Fatal("account isn't closed")
+	}
+	if err := repos.Users.Close(ctx, "alice"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("closing twice: err = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,1112 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/google/uuid"
+)
+
+// NewPostgres builds every repository on top of one shared pool
+func NewPostgres(db *sql.DB) *Repos {
+	return &Repos{
+		Users:     &pgUsers{db: db},
+		Balances:  &pgBalances{db: db},
+		Games:     &pgGames{db: db},
+		Sessions:  &pgSessions{db: db},
+		Audit:     &pgAudit{db: db},
+		Events:    &pgEvents{db: db},
+		Deposits:  &pgDeposits{db: db},
+		Addresses: &pgAddresses{db: db},
+	}
+}
+
+type pgUsers struct {
+	db *sql.DB
+}
+
+func (r *pgUsers) CountByEmail(ctx context.Context, email string) (int, error) {
+	var count int
+	err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE email = $1", email).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting users: %w", err)
+	}
+	return count, nil
+}
+
+// userColumns are the columns scanUser reads, in order
+const userColumns = "id, oauthid, email, provider, obfuscatedid, role, created_at, closed_at"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	var email sql.NullString
+	var closedAt sql.NullTime
+	err := row.Scan(&u.ID, &u.OAuthID, &email, &u.Provider, &u.ObfID, &u.Role, &u.CreatedAt, &closedAt)
+	u.Email = email.String
+	if closedAt.Valid {
+		u.ClosedAt = &closedAt.Time
+	}
+	return u, err
+}
+
+func (r *pgUsers) FindByOAuthID(ctx context.Context, oauthID string) (User, error) {
+	u, err := scanUser(r.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE oauthid = $1", oauthID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, ErrNotFound
+	}
+	if err != nil {
+		return u, fmt.Errorf("error finding user: %w", err)
+	}
+	return u, nil
+}
+
+func (r *pgUsers) FindByObfID(ctx context.Context, obfID string) (User, error) {
+	u, err := scanUser(r.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE obfuscatedid = $1", obfID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, ErrNotFound
+	}
+	if err != nil {
+		return u, fmt.Errorf("error finding user: %w", err)
+	}
+	return u, nil
+}
+
+func (r *pgUsers) List(ctx context.Context, search string, limit int) ([]User, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select `+userColumns+`
+		from users
+		where $1 = '' or obfuscatedid like '%' || $1 || '%' or email ilike '%' || $1 || '%'
+		order by created_at desc
+		limit $2
+	`, search, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning user: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading users: %w", err)
+	}
+	return users, nil
+}
+
+func (r *pgUsers) SetRole(ctx context.Context, obfID, role string) error {
+	res, err := r.db.ExecContext(ctx, "UPDATE users SET role = $1 WHERE obfuscatedid = $2", role, obfID)
+	if err != nil {
+		return fmt.Errorf("error setting role: %w", err)
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *pgUsers) Create(ctx context.Context, u User) error {
+	return inTx(ctx, r.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO users(oauthid, email, provider, obfuscatedid) VALUES ($1, $2, $3, $4)",
+			u.OAuthID, u.Email, u.Provider, u.ObfID)
+		if err != nil {
+			return fmt.Errorf("error inserting user: %w", err)
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO identities(provider, provider_user_id, obfuscatedid, email) VALUES ($1, $2, $3, $4)",
+			u.Provider, u.OAuthID, u.ObfID, u.Email)
+		if err != nil {
+			return fmt.Errorf("error inserting identity: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *pgUsers) Close(ctx context.Context, obfID string) error {
+	return inTx(ctx, r.db, func(tx *sql.Tx) error {
+		// the row lock is held to the end, so two closes can't both get
+		// past the checks
+		var open bool
+		err := tx.QueryRowContext(ctx, `
+			select closed_at is null from users
+			where obfuscatedid = $1
+			for update
+		`, obfID).Scan(&open)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !open) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("error locking user: %w", err)
+		}
+
+		// the same statuses as deposit.InFlight
+		var inFlight bool
+		err = tx.QueryRowContext(ctx, `
+			select exists (
+				select 1 from deposits
+				where obfuscatedid = $1 and status in ('pending', 'capturing')
+			)
+		`, obfID).Scan(&inFlight)
+		if err != nil {
+			return fmt.Errorf("error checking deposits: %w", err)
+		}
+		if inFlight {
+			return ErrAccountBusy
+		}
+
+		res, err := tx.ExecContext(ctx, `
+			update users
+			set email = null, oauthid = 'closed-' || obfuscatedid, closed_at = now()
+			where obfuscatedid = $1 and closed_at is null
+		`, obfID)
+		if err != nil {
+			return fmt.Errorf("error closing user: %w", err)
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+			return ErrNotFound
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM identities WHERE obfuscatedid = $1", obfID)
+		if err != nil {
+			return fmt.Errorf("error deleting identities: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *pgUsers) FindIdentity(ctx context.Context, provider, providerUserID string) (Identity, error) {
+	var id Identity
+	var email sql.NullString
+	query := `
+		select provider, provider_user_id, obfuscatedid, email, created_at
+		from identities
+		where provider = $1 and provider_user_id = $2
+	`
+	err := r.db.QueryRowContext(ctx, query, provider, providerUserID).Scan(&id.Provider, &id.ProviderUserID, &id.ObfID, &email, &id.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return id, ErrNotFound
+	}
+	if err != nil {
+		return id, fmt.Errorf("error finding identity: %w", err)
+	}
+	id.Email = email.String
+	return id, nil
+}
+
+func (r *pgUsers) LinkIdentity(ctx context.Context, id Identity) error {
+	// the primary key settles two accounts racing for the same login
+	query := `
+		insert into identities
+		(provider, provider_user_id, obfuscatedid, email)
+		values ($1, $2, $3, $4)
+		on conflict (provider, provider_user_id) do nothing
+	`
+	res, err := r.db.ExecContext(ctx, query, id.Provider, id.ProviderUserID, id.ObfID, id.Email)
+	if err != nil {
+		return fmt.Errorf("error linking identity: %w", err)
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected > 0 {
+		return nil
+	}
+
+	existing, err := r.FindIdentity(ctx, id.Provider, id.ProviderUserID)
+	if err != nil {
+		return err
+	}
+	if existing.ObfID != id.ObfID {
+		return ErrAlreadyLinked
+	}
+	return nil
+}
+
+func (r *pgUsers) ListIdentities(ctx context.Context, obfID string) ([]Identity, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select provider, provider_user_id, obfuscatedid, email, created_at
+		from identities
+		where obfuscatedid = $1
+		order by created_at
+	`, obfID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing identities: %w", err)
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		var id Identity
+		var email sql.NullString
+		if err := rows.Scan(&id.Provider, &id.ProviderUserID, &id.ObfID, &email, &id.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning identity: %w", err)
+		}
+		id.Email = email.String
+		identities = append(identities, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading identities: %w", err)
+	}
+	return identities, nil
+}
+
+func (r *pgUsers) UnlinkIdentity(ctx context.Context, obfID, provider, providerUserID string) error {
+	return inTx(ctx, r.db, func(tx *sql.Tx) error {
+		// lock the account's identities so two unlinks can't both see two left
+		var count int
+		err := tx.QueryRowContext(ctx, `
+			select count(*) from (
+				select 1 from identities where obfuscatedid = $1 for update
+			) linked
+		`, obfID).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("error counting identities: %w", err)
+		}
+
+		res, err := tx.ExecContext(ctx, `
+			delete from identities
+			where obfuscatedid = $1 and provider = $2 and provider_user_id = $3
+		`, obfID, provider, providerUserID)
+		if err != nil {
+			return fmt.Errorf("error unlinking identity: %w", err)
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+			return ErrNotFound
+		}
+		if count <= 1 {
+			// rolled back by inTx
+			return ErrLastIdentity
+		}
+		return nil
+	})
+}
+
+type pgBalances struct {
+	db *sql.DB
+}
+
+func (r *pgBalances) Post(ctx context.Context, p Posting) (string, error) {
+	var txID string
+	err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+		var err error
+		txID, err = post(ctx, tx, p)
+		return err
+	})
+	return txID, err
+}
+
+func (r *pgBalances) TopUp(ctx context.Context, p Posting, allowance money.Amount) (money.Amount, error) {
+	var added money.Amount
+	err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+		// claim today's top up, the row lock means two requests can't both win
+		claim := `
+			insert into chip_topups
+			(obfuscatedid, topped_up_on)
+			values ($1, current_date)
+			on conflict (obfuscatedid)
+			do update set topped_up_on = excluded.topped_up_on
+			where chip_topups.topped_up_on < excluded.topped_up_on
+		`
+		res, err := tx.ExecContext(ctx, claim, p.ObfID)
+		if err != nil {
+			return fmt.Errorf("error claiming top up: %w", err)
+		}
+		rowsAffected, _ := res.RowsAffected()
+		if rowsAffected == 0 {
+			// already topped up today
+			return nil
+		}
+
+		var balance money.Amount
+		err = tx.QueryRowContext(ctx, `
+			select coalesce(sum(amount), 0)
+			from balances
+			where obfuscatedid = $1 and currency = $2
+		`, p.ObfID, p.Currency).Scan(&balance)
+		if err != nil {
+			return fmt.Errorf("error fetching balance: %w", err)
+		}
+		if balance >= allowance {
+			return nil
+		}
+
+		p.Amount = allowance - balance
+		if _, err := post(ctx, tx, p); err != nil {
+			return err
+		}
+		added = p.Amount
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+func (r *pgBalances) Balances(ctx context.Context, obfID string) (map[string]money.Amount, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select currency, amount
+		from balances
+		where obfuscatedid = $1
+	`, obfID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching balances: %w", err)
+	}
+	defer rows.Close()
+
+	balances := make(map[string]money.Amount)
+	for rows.Next() {
+		var currency string
+		var amount money.Amount
+		if err := rows.Scan(&currency, &amount); err != nil {
+			return nil, fmt.Errorf("error scanning balance: %w", err)
+		}
+		balances[currency] = amount
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading balances: %w", err)
+	}
+	return balances, nil
+}
+
+func (r *pgBalances) AllBalances(ctx context.Context) (map[string]map[string]money.Amount, error) {
+	return r.sums(ctx, `
+		select obfuscatedid, currency, amount
+		from balances
+	`)
+}
+
+func (r *pgBalances) JournalSums(ctx context.Context) (map[string]map[string]money.Amount, error) {
+	return r.sums(ctx, `
+		select account, currency, sum(amount)
+		from ledger_entries
+		where account <> $1
+		group by account, currency
+	`, HouseAccount)
+}
+
+func (r *pgBalances) UnbalancedTransactions(ctx context.Context) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select txid
+		from ledger_entries
+		group by txid, currency
+		having sum(amount) <> 0
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error checking ledger transactions: %w", err)
+	}
+	defer rows.Close()
+
+	var txIDs []string
+	for rows.Next() {
+		var txID string
+		if err := rows.Scan(&txID); err != nil {
+			return nil, fmt.Errorf("error scanning ledger transaction: %w", err)
+		}
+		txIDs = append(txIDs, txID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading ledger transactions: %w", err)
+	}
+	return txIDs, nil
+}
+
+func (r *pgBalances) TopBalances(ctx context.Context, currency string, limit int) ([]Standing, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select obfuscatedid, amount
+		from balances
+		where currency = $1
+		order by amount desc, obfuscatedid
+		limit $2
+	`, currency, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching top balances: %w", err)
+	}
+	defer rows.Close()
+
+	var standings []Standing
+	for rows.Next() {
+		var s Standing
+		if err := rows.Scan(&s.ObfID, &s.Amount); err != nil {
+			return nil, fmt.Errorf("error scanning top balance: %w", err)
+		}
+		standings = append(standings, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading top balances: %w", err)
+	}
+	return standings, nil
+}
+
+func (r *pgBalances) Journal(ctx context.Context, obfID string) ([]JournalEntry, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select txid, currency, amount, kind, reference, created_at
+		from ledger_entries
+		where account = $1
+		order by id
+	`, obfID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching journal: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []JournalEntry
+	for rows.Next() {
+		var e JournalEntry
+		if err := rows.Scan(&e.TxID, &e.Currency, &e.Amount, &e.Kind, &e.Reference, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning journal entry: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading journal: %w", err)
+	}
+	return entries, nil
+}
+
+// sums reads (player, currency, amount) rows into a nested map
+func (r *pgBalances) sums(ctx context.Context, query string, args ...any) (map[string]map[string]money.Amount, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error summing balances: %w", err)
+	}
+	defer rows.Close()
+
+	sums := make(map[string]map[string]money.Amount)
+	for rows.Next() {
+		var obfID, currency string
+		var amount money.Amount
+		if err := rows.Scan(&obfID, &currency, &amount); err != nil {
+			return nil, fmt.Errorf("error scanning balance sum: %w", err)
+		}
+		if sums[obfID] == nil {
+			sums[obfID] = make(map[string]money.Amount)
+		}
+		sums[obfID][currency] = amount
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading balance sums: %w", err)
+	}
+	return sums, nil
+}
+
+// inTx runs fn in a transaction, committing only if it returns nil
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	// #nosec G104 -- rollback after commit is a no-op
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// post writes both legs of p to the journal and applies it to the cached
+// balance inside the callers transaction
+func post(ctx context.Context, tx *sql.Tx, p Posting) (string, error) {
+	if p.Amount < 0 {
+		// debit only if the money is there, the row lock taken by the update
+		// makes concurrent bets queue up behind each other instead of both
+		// reading the same balance
+		debit := `
+			update balances
+			set amount = amount + $1
+			where obfuscatedid = $2 and currency = $3 and amount >= $4
+		`
+		res, err := tx.ExecContext(ctx, debit, p.Amount, p.ObfID, p.Currency, -p.Amount)
+		if err != nil {
+			return "", fmt.Errorf("error debiting balance: %w", err)
+		}
+		rowsAffected, _ := res.RowsAffected()
+		if rowsAffected == 0 {
+			return "", ErrInsufficientFunds
+		}
+	} else {
+		credit := `
+			insert into balances
+			(obfuscatedid, currency, amount)
+			values ($1, $2, $3)
+			on conflict (obfuscatedid, currency)
+			do update set amount = balances.amount + excluded.amount
+		`
+		_, err := tx.ExecContext(ctx, credit, p.ObfID, p.Currency, p.Amount)
+		if err != nil {
+			return "", fmt.Errorf("error crediting balance: %w", err)
+		}
+	}
+
+	txID := uuid.NewString()
+
+	// both legs of the entry, they always sum to zero
+	query := `
+		insert into ledger_entries
+		(txid, account, currency, amount, kind, reference)
+		values ($1, $2, $3, $4, $5, $6), ($1, $7, $3, $8, $5, $6)
+	`
+	_, err := tx.ExecContext(ctx, query, txID, p.ObfID, p.Currency, p.Amount, p.Kind, p.Reference, HouseAccount, -p.Amount)
+	if err != nil {
+		return "", fmt.Errorf("error inserting ledger entries: %w", err)
+	}
+
+	// the event is only queued here, chaining it takes the audit log's lock
+	// and holding that for the rest of the posting's transaction would put
+	// every bet, payout and deposit in one line
+	if p.Audit != nil {
+		e, err := p.Audit(p, txID)
+		if err != nil {
+			return "", err
+		}
+		query := `
+			insert into audit_queue
+			(type, actor, subject, data, created_at)
+			values ($1, $2, $3, $4, $5)
+		`
+		_, err = tx.ExecContext(ctx, query, e.Type, e.Actor, e.Subject, e.Data, e.CreatedAt)
+		if err != nil {
+			return "", fmt.Errorf("error queueing audit event: %w", err)
+		}
+	}
+	return txID, nil
+}
+
+type pgGames struct {
+	db *sql.DB
+}
+
+func (r *pgGames) RecordHistory(ctx context.Context, e HistoryEntry) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+
+	query := `
+		insert into hand_history
+		(gameid, obfuscatedid, action, player_hand, dealer_hand, bet_amount, bet_currency, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err := r.db.ExecContext(ctx, query, e.GameID, e.ObfID, e.Action, e.Player, e.Dealer, e.BetAmount, e.BetCurrency, e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error inserting hand history: %w", err)
+	}
+	return nil
+}
+
+type pgSessions struct {
+	db *sql.DB
+}
+
+func (r *pgSessions) Create(ctx context.Context, s Session) error {
+	query := `
+		insert into sessions
+		(id, userid, obfuscatedid, user_agent, ip, created_at, last_seen)
+		values ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := r.db.ExecContext(ctx, query, s.ID, s.UserID, s.ObfID, s.UserAgent, s.IP, s.CreatedAt, s.LastSeen)
+	if err != nil {
+		return fmt.Errorf("error inserting session: %w", err)
+	}
+	return nil
+}
+
+func (r *pgSessions) Find(ctx context.Context, id string) (Session, error) {
+	var s Session
+	query := `
+		select id, userid, obfuscatedid, user_agent, ip, created_at, last_seen
+		from sessions
+		where id = $1
+	`
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&s.ID, &s.UserID, &s.ObfID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeen)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, ErrNotFound
+	}
+	if err != nil {
+		return s, fmt.Errorf("error finding session: %w", err)
+	}
+	return s, nil
+}
+
+func (r *pgSessions) Touch(ctx context.Context, id string, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE sessions SET last_seen = $1 WHERE id = $2", at, id)
+	if err != nil {
+		return fmt.Errorf("error touching session: %w", err)
+	}
+	return nil
+}
+
+func (r *pgSessions) Delete(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("error deleting session: %w", err)
+	}
+	return nil
+}
+
+func (r *pgSessions) ListByUser(ctx context.Context, userID string) ([]Session, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select id, userid, obfuscatedid, user_agent, ip, created_at, last_seen
+		from sessions
+		where userid = $1
+		order by last_seen desc
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.ObfID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeen); err != nil {
+			return nil, fmt.Errorf("error scanning session: %w", err)
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+func (r *pgSessions) DeleteByUser(ctx context.Context, userID string) (int, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM sessions WHERE userid = $1", userID)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting sessions: %w", err)
+	}
+	deleted, _ := res.RowsAffected()
+	return int(deleted), nil
+}
+
+func (r *pgSessions) DeleteExpired(ctx context.Context, idleBefore, createdBefore time.Time) (int, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM sessions WHERE last_seen < $1 OR created_at < $2", idleBefore, createdBefore)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired sessions: %w", err)
+	}
+	deleted, _ := res.RowsAffected()
+	return int(deleted), nil
+}
+
+func (r *pgGames) History(ctx context.Context, obfID string) ([]HistoryEntry, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select gameid, obfuscatedid, action, player_hand, dealer_hand, bet_amount, bet_currency, created_at
+		from hand_history
+		where obfuscatedid = $1
+		order by id
+	`, obfID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching hand history: %w", err)
+	}
+	defer rows.Close()
+
+	var history []HistoryEntry
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(&e.GameID, &e.ObfID, &e.Action, &e.Player, &e.Dealer, &e.BetAmount, &e.BetCurrency, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning hand history: %w", err)
+		}
+		history = append(history, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading hand history: %w", err)
+	}
+	return history, nil
+}
+
+type pgAudit struct {
+	db *sql.DB
+}
+
+func (r *pgAudit) Append(ctx context.Context, e AuditEntry) error {
+	query := `
+		insert into admin_audit
+		(actor, action, target, detail)
+		values ($1, $2, $3, $4)
+	`
+	_, err := r.db.ExecContext(ctx, query, e.Actor, e.Action, e.Target, e.Detail)
+	if err != nil {
+		return fmt.Errorf("error inserting audit entry: %w", err)
+	}
+	return nil
+}
+
+func (r *pgAudit) List(ctx context.Context, limit int) ([]AuditEntry, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select id, actor, action, target, detail, created_at
+		from admin_audit
+		order by id desc
+		limit $1
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.Target, &e.Detail, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning audit entry: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit entries: %w", err)
+	}
+	return entries, nil
+}
+
+type pgEvents struct {
+	db *sql.DB
+}
+
+func (r *pgEvents) Append(ctx context.Context, seal func(last Event) (Event, error)) (Event, error) {
+	var e Event
+	err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+		var err error
+		e, err = appendEvent(ctx, tx, seal)
+		return err
+	})
+	return e, err
+}
+
+// appendEvent adds the event seal builds to the audit log as part of tx
+func appendEvent(ctx context.Context, tx *sql.Tx, seal func(last Event) (Event, error)) (Event, error) {
+	last, err := lockAuditLog(ctx, tx)
+	if err != nil {
+		return Event{}, err
+	}
+
+	e, err := seal(last)
+	if err != nil {
+		return e, err
+	}
+	return e, insertEvent(ctx, tx, e)
+}
+
+// lockAuditLog makes tx the only one adding to the audit log until it ends,
+// and returns the last event in it
+func lockAuditLog(ctx context.Context, tx *sql.Tx) (Event, error) {
+	if _, err := tx.ExecContext(ctx, "select pg_advisory_xact_lock(hashtext('audit_log'))"); err != nil {
+		return Event{}, fmt.Errorf("error locking audit log: %w", err)
+	}
+
+	var last Event
+	err := tx.QueryRowContext(ctx, "select seq, hash from audit_log order by seq desc limit 1").Scan(&last.Seq, &last.Hash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Event{}, fmt.Errorf("error reading last audit event: %w", err)
+	}
+	return last, nil
+}
+
+func insertEvent(ctx context.Context, tx *sql.Tx, e Event) error {
+	query := `
+		insert into audit_log
+		(seq, type, actor, subject, data, created_at, prev_hash, hash)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err := tx.ExecContext(ctx, query, e.Seq, e.Type, e.Actor, e.Subject, e.Data, e.CreatedAt, e.PrevHash, e.Hash)
+	if err != nil {
+		return fmt.Errorf("error inserting audit event: %w", err)
+	}
+	return nil
+}
+
+type queuedEvent struct {
+	id int64
+	Event
+}
+
+// chainBatch is how many queued events Chain moves per transaction
+const chainBatch = 500
+
+func (r *pgEvents) Chain(ctx context.Context, link func(e, last Event) Event) (int, error) {
+	chained := 0
+	for {
+		n := 0
+		err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+			last, err := lockAuditLog(ctx, tx)
+			if err != nil {
+				return err
+			}
+
+			// taken off the queue as they're read, only committed postings
+			// are seen, one still open is picked up by a later Chain
+			rows, err := tx.QueryContext(ctx, `
+				delete from audit_queue
+				where id in (select id from audit_queue order by id limit $1)
+				returning id, type, actor, subject, data, created_at
+			`, chainBatch)
+			if err != nil {
+				return fmt.Errorf("error taking queued audit events: %w", err)
+			}
+			var queued []queuedEvent
+			for rows.Next() {
+				var q queuedEvent
+				if err := rows.Scan(&q.id, &q.Type, &q.Actor, &q.Subject, &q.Data, &q.CreatedAt); err != nil {
+					rows.Close()
+					return fmt.Errorf("error scanning queued audit event: %w", err)
+				}
+				queued = append(queued, q)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("error reading queued audit events: %w", err)
+			}
+
+			// returning doesn't keep the order
+			sort.Slice(queued, func(i, j int) bool { return queued[i].id < queued[j].id })
+			for _, q := range queued {
+				e := link(q.Event, last)
+				if err := insertEvent(ctx, tx, e); err != nil {
+					return err
+				}
+				last = e
+			}
+			n = len(queued)
+			return nil
+		})
+		chained += n
+		if err != nil || n < chainBatch {
+			return chained, err
+		}
+	}
+}
+
+func (r *pgEvents) Events(ctx context.Context, afterSeq int64, limit int) ([]Event, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select seq, type, actor, subject, data, created_at, prev_hash, hash
+		from audit_log
+		where seq > $1
+		order by seq
+		limit $2
+	`, afterSeq, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing audit events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.Seq, &e.Type, &e.Actor, &e.Subject, &e.Data, &e.CreatedAt, &e.PrevHash, &e.Hash); err != nil {
+			return nil, fmt.Errorf("error scanning audit event: %w", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit events: %w", err)
+	}
+	return events, nil
+}
+
+type pgDeposits struct {
+	db *sql.DB
+}
+
+// depositColumns are the columns scanDeposit reads, in order
+const depositColumns = "id, obfuscatedid, method, currency, amount, status, card, authorization_id, failure_reason, wallet, coalesce(tx_signature, ''), created_at, updated_at"
+
+func scanDeposit(row rowScanner) (Deposit, error) {
+	var d Deposit
+	err := row.Scan(&d.ID, &d.ObfID, &d.Method, &d.Currency, &d.Amount, &d.Status, &d.Card,
+		&d.AuthorizationID, &d.FailureReason, &d.Wallet, &d.TxSignature, &d.CreatedAt, &d.UpdatedAt)
+	return d, err
+}
+
+func (r *pgDeposits) Create(ctx context.Context, d Deposit) error {
+	// the unique (tx_signature, obfuscatedid) is what stops a transaction being
+	// credited twice, so a clash is reported rather than failing like any
+	// other error
+	query := `
+		insert into deposits
+		(id, obfuscatedid, method, currency, amount, status, card, wallet, tx_signature)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, nullif($9, ''))
+		on conflict do nothing
+	`
+	res, err := r.db.ExecContext(ctx, query, d.ID, d.ObfID, d.Method, d.Currency, d.Amount, d.Status, d.Card,
+		d.Wallet, d.TxSignature)
+	if err != nil {
+		return fmt.Errorf("error inserting deposit: %w", err)
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return ErrDuplicate
+	}
+	return nil
+}
+
+func (r *pgDeposits) Find(ctx context.Context, id string) (Deposit, error) {
+	d, err := scanDeposit(r.db.QueryRowContext(ctx, "SELECT "+depositColumns+" FROM deposits WHERE id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, ErrNotFound
+	}
+	if err != nil {
+		return d, fmt.Errorf("error finding deposit: %w", err)
+	}
+	return d, nil
+}
+
+func (r *pgDeposits) SetAuthorization(ctx context.Context, id, authorizationID string) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE deposits SET authorization_id = $1, updated_at = now() WHERE id = $2", authorizationID, id)
+	if err != nil {
+		return fmt.Errorf("error setting deposit authorization: %w", err)
+	}
+	return nil
+}
+
+func (r *pgDeposits) Transition(ctx context.Context, id, from, to, reason string) error {
+	res, err := r.db.ExecContext(ctx, `
+		update deposits
+		set status = $1, failure_reason = $2, updated_at = now()
+		where id = $3 and status = $4
+	`, to, reason, id, from)
+	if err != nil {
+		return fmt.Errorf("error updating deposit status: %w", err)
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *pgDeposits) Credit(ctx context.Context, id, from, to, reason string, p Posting) (string, error) {
+	var txID string
+	err := inTx(ctx, r.db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `
+			update deposits
+			set status = $1, failure_reason = $2, updated_at = now()
+			where id = $3 and status = $4
+		`, to, reason, id, from)
+		if err != nil {
+			return fmt.Errorf("error updating deposit status: %w", err)
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		txID, err = post(ctx, tx, p)
+		return err
+	})
+	return txID, err
+}
+
+func (r *pgDeposits) ListByUser(ctx context.Context, obfID string) ([]Deposit, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+depositColumns+" FROM deposits WHERE obfuscatedid = $1 ORDER BY created_at DESC", obfID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing deposits: %w", err)
+	}
+	defer rows.Close()
+
+	var deposits []Deposit
+	for rows.Next() {
+		d, err := scanDeposit(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning deposit: %w", err)
+		}
+		deposits = append(deposits, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading deposits: %w", err)
+	}
+	return deposits, nil
+}
+
+func (r *pgDeposits) ListPending(ctx context.Context, method string) ([]Deposit, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+depositColumns+" FROM deposits WHERE status = 'pending' AND method = $1 ORDER BY created_at", method)
+	if err != nil {
+		return nil, fmt.Errorf("error listing pending deposits: %w", err)
+	}
+	defer rows.Close()
+
+	var deposits []Deposit
+	for rows.Next() {
+		d, err := scanDeposit(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning deposit: %w", err)
+		}
+		deposits = append(deposits, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading deposits: %w", err)
+	}
+	return deposits, nil
+}
+
+type pgAddresses struct {
+	db *sql.DB
+}
+
+func (r *pgAddresses) Issue(ctx context.Context, obfID, address string) (DepositAddress, error) {
+	// one address per player, the first one issued sticks
+	_, err := r.db.ExecContext(ctx, `
+		insert into deposit_addresses (obfuscatedid, address)
+		values ($1, $2)
+		on conflict do nothing
+	`, obfID, address)
+	if err != nil {
+		return DepositAddress{}, fmt.Errorf("error issuing deposit address: %w", err)
+	}
+
+	var a DepositAddress
+	err = r.db.QueryRowContext(ctx,
+		"SELECT obfuscatedid, address, cursor, created_at FROM deposit_addresses WHERE obfuscatedid = $1", obfID,
+	).Scan(&a.ObfID, &a.Address, &a.Cursor, &a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		// nothing was inserted and the player has no address, so the
+		// address is someone else's
+		return a, ErrDuplicate
+	}
+	if err != nil {
+		return a, fmt.Errorf("error finding deposit address: %w", err)
+	}
+	return a, nil
+}
+
+func (r *pgAddresses) List(ctx context.Context) ([]DepositAddress, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		select a.obfuscatedid, a.address, a.cursor, a.created_at
+		from deposit_addresses a
+		join users u on u.obfuscatedid = a.obfuscatedid
+		where u.closed_at is null
+		order by a.created_at
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing deposit addresses: %w", err)
+	}
+	defer rows.Close()
+
+	var addresses []DepositAddress
+	for rows.Next() {
+		var a DepositAddress
+		if err := rows.Scan(&a.ObfID, &a.Address, &a.Cursor, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning deposit address: %w", err)
+		}
+		addresses = append(addresses, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading deposit addresses: %w", err)
+	}
+	return addresses, nil
+}
+
+func (r *pgAddresses) SetCursor(ctx context.Context, obfID, signature string) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE deposit_addresses SET cursor = $1 WHERE obfuscatedid = $2", signature, obfID)
+	if err != nil {
+		return fmt.Errorf("error setting deposit address cursor: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/money"
+)
+
+// ErrNotFound is returned when a lookup matches nothing
+var ErrNotFound = errors.New("not found")
+
+// ErrInsufficientFunds is returned when a debit would take a balance below zero
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// ErrAlreadyLinked is returned when a provider login already belongs to another account
+var ErrAlreadyLinked = errors.New("identity already linked to another account")
+
+// ErrLastIdentity is returned when unlinking would leave an account with no way to sign in
+var ErrLastIdentity = errors.New("cannot unlink the last sign in method")
+
+// ErrDuplicate is returned when something that has to be unique already exists
+var ErrDuplicate = errors.New("already exists")
+
+// ErrAccountBusy is returned when an account can't be closed because money
+// is still on its way in
+var ErrAccountBusy = errors.New("account has deposits in flight")
+
+// HouseAccount is the other side of every player posting
+const HouseAccount = "house"
+
+// User is a row of the users table
+type User struct {
+	ID        int64
+	OAuthID   string
+	Email     string
+	Provider  string
+	ObfID     string
+	Role      string // player, support or admin
+	CreatedAt time.Time
+	ClosedAt  *time.Time // nil while the account is open
+}
+
+// Closed reports whether the account has been closed
+func (u User) Closed() bool {
+	return u.ClosedAt != nil
+}
+
+// Identity is one provider login that reaches an account. An account has at
+// least one, the one it was created with, and can link more
+type Identity struct {
+	Provider       string
+	ProviderUserID string
+	ObfID          string
+	Email          string
+	CreatedAt      time.Time
+}
+
+// Posting moves Amount between a player and the house. A positive Amount
+// credits the player, a negative one debits them
+type Posting struct {
+	Kind      string
+	ObfID     string
+	Currency  string
+	Amount    money.Amount
+	Reference string
+	// Audit, if set, builds the posting's audit event once its transaction
+	// id is known, without its place in the chain. The event is queued in the
+	// same transaction as the journal entries, so there's never one without
+	// the other, and Chain adds it to the log afterwards
+	Audit func(p Posting, txID string) (Event, error)
+}
+
+// JournalEntry is the player's leg of one ledger transaction
+type JournalEntry struct {
+	TxID      string
+	Currency  string
+	Amount    money.Amount
+	Kind      string
+	Reference string
+	CreatedAt time.Time
+}
+
+// Standing is a player's balance in one currency, for leaderboards
+type Standing struct {
+	ObfID  string
+	Amount money.Amount
+}
+
+// HistoryEntry is one line of the hand history
+type HistoryEntry struct {
+	GameID      string
+	ObfID       string
+	Action      string
+	Player      string
+	Dealer      string
+	BetAmount   money.Amount
+	BetCurrency string
+	CreatedAt   time.Time
+}
+
+// Session is a signed in browser. ID is a hash of the token in the cookie,
+// so the table alone is never enough to sign in as anyone
+type Session struct {
+	ID        string
+	UserID    string
+	ObfID     string
+	UserAgent string
+	IP        string
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+// UserRepo stores players and the provider logins linked to them
+type UserRepo interface {
+	CountByEmail(ctx context.Context, email string) (int, error)
+	FindByOAuthID(ctx context.Context, oauthID string) (User, error)
+	FindByObfID(ctx context.Context, obfID string) (User, error)
+	// List returns up to limit accounts whose obfuscated id or email contains
+	// search, newest first
+	List(ctx context.Context, search string, limit int) ([]User, error)
+	SetRole(ctx context.Context, obfID, role string) error
+	// Create adds the account along with the identity it signed up with,
+	// u.Provider and u.OAuthID
+	Create(ctx context.Context, u User) error
+	// Close soft-deletes the account: the row stays so its obfuscated id is
+	// never reused and the ledger still points somewhere, but the email and
+	// oauthid are anonymised and every linked login is removed. It's
+	// ErrAccountBusy while a deposit is pending or capturing, checked in the
+	// same transaction so one can't start between the check and the close
+	Close(ctx context.Context, obfID string) error
+
+	FindIdentity(ctx context.Context, provider, providerUserID string) (Identity, error)
+	// LinkIdentity adds a login to an account. Linking one the account already
+	// has is a no-op, one that belongs to someone else is ErrAlreadyLinked
+	LinkIdentity(ctx context.Context, id Identity) error
+	ListIdentities(ctx context.Context, obfID string) ([]Identity, error)
+	// UnlinkIdentity removes a login, refusing with ErrLastIdentity if it's
+	// the only one the account has left
+	UnlinkIdentity(ctx context.Context, obfID, provider, providerUserID string) error
+}
+
+// BalanceRepo stores the ledger journal and the balances cached from it.
+// Every method that moves money writes the journal entries and the balance
+// change atomically
+type BalanceRepo interface {
+	// Post journals p against the house and applies it to the player's
+	// balance, failing with ErrInsufficientFunds rather than going negative.
+	// It returns the journal transaction id
+	Post(ctx context.Context, p Posting) (string, error)
+	// TopUp credits p's player's balance in p's currency up to allowance, at
+	// most once per calendar day, and returns how much was added. p's Amount
+	// is filled in with that before it's posted
+	TopUp(ctx context.Context, p Posting, allowance money.Amount) (money.Amount, error)
+	Balances(ctx context.Context, obfID string) (map[string]money.Amount, error)
+	AllBalances(ctx context.Context) (map[string]map[string]money.Amount, error)
+	// JournalSums totals the journal per player and currency, leaving out the house
+	JournalSums(ctx context.Context) (map[string]map[string]money.Amount, error)
+	// UnbalancedTransactions returns journal transactions whose legs don't sum to zero
+	UnbalancedTransactions(ctx context.Context) ([]string, error)
+	TopBalances(ctx context.Context, currency string, limit int) ([]Standing, error)
+	// Journal is every ledger entry on the player's account, oldest first
+	Journal(ctx context.Context, obfID string) ([]JournalEntry, error)
+}
+
+// GameRepo stores what happened at the tables
+type GameRepo interface {
+	RecordHistory(ctx context.Context, e HistoryEntry) error
+	// History is every hand the player has on record, oldest first
+	History(ctx context.Context, obfID string) ([]HistoryEntry, error)
+}
+
+// SessionRepo stores the server side of every session, so a session can be
+// revoked no matter who holds the cookie
+type SessionRepo interface {
+	Create(ctx context.Context, s Session) error
+	Find(ctx context.Context, id string) (Session, error)
+	Touch(ctx context.Context, id string, at time.Time) error
+	Delete(ctx context.Context, id string) error
+	ListByUser(ctx context.Context, userID string) ([]Session, error)
+	// DeleteByUser revokes every session the player has and returns how many
+	DeleteByUser(ctx context.Context, userID string) (int, error)
+	// DeleteExpired removes sessions last seen before idleBefore or created
+	// before createdBefore
+	DeleteExpired(ctx context.Context, idleBefore, createdBefore time.Time) (int, error)
+}
+
+// AuditEntry is one thing a member of staff did
+type AuditEntry struct {
+	ID        int64
+	Actor     string // obfuscated id of the staff member, or "cli"
+	Action    string
+	Target    string // obfuscated id of the player it was done to, if any
+	Detail    string
+	CreatedAt time.Time
+}
+
+// AuditRepo stores the staff audit log. Entries are only ever appended
+type AuditRepo interface {
+	Append(ctx context.Context, e AuditEntry) error
+	// List returns the newest limit entries, newest first
+	List(ctx context.Context, limit int) ([]AuditEntry, error)
+}
+
+// Event is one record in the tamper evident audit log. Each one carries the
+// hash of the one before it, so editing, deleting or reordering any of them
+// breaks the chain from that point on
+type Event struct {
+	Seq       int64 // 1, 2, 3... with no gaps
+	Type      string
+	Actor     string // who did it, an obfuscated id, "system" or "cli"
+	Subject   string // whose account it happened to, if anyone's
+	Data      string // JSON
+	CreatedAt time.Time
+	PrevHash  string
+	Hash      string
+}
+
+// EventRepo stores the audit log. Events are only ever appended
+type EventRepo interface {
+	// Append adds the event seal builds from the last one in the log, or from
+	// the zero Event if the log is empty. Appends are serialised, so no two
+	// events ever follow the same one
+	Append(ctx context.Context, seal func(last Event) (Event, error)) (Event, error)
+	// Chain moves the events postings queued onto the end of the log, oldest
+	// first, with link setting each one's place after the last. It's
+	// serialised with Append, but never held up by a posting, and returns
+	// how many it chained
+	Chain(ctx context.Context, link func(e, last Event) Event) (int, error)
+	// Events returns up to limit events after seq, oldest first
+	Events(ctx context.Context, afterSeq int64, limit int) ([]Event, error)
+}
+
+// Deposit is one attempt to pay money in, from the moment it's started until
+// the processor says yes or no
+type Deposit struct {
+	ID              string // our reference for it, the processor knows it by this too
+	ObfID           string
+	Method          string // "card" or "solana"
+	Currency        string
+	Amount          money.Amount
+	Status          string // pending, confirmed, failed or refunded
+	Card            string // brand and last 4 digits, never the number
+	AuthorizationID string
+	FailureReason   string
+	Wallet          string // the wallet a Solana deposit was sent from
+	TxSignature     string // the Solana transaction, only ever credited once to each player
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// DepositRepo stores deposits and the state they're in
+type DepositRepo interface {
+	// Create returns ErrDuplicate if the ID is taken, or the player already
+	// has a deposit for the transaction signature
+	Create(ctx context.Context, d Deposit) error
+	Find(ctx context.Context, id string) (Deposit, error)
+	SetAuthorization(ctx context.Context, id, authorizationID string) error
+	// Transition moves the deposit from one status to another, and returns
+	// ErrNotFound if it wasn't in from. Only one of two racing callers wins
+	Transition(ctx context.Context, id, from, to, reason string) error
+	// Credit is Transition and journaling p in the same transaction, so a
+	// deposit can't be confirmed without its credit or the other way round.
+	// It returns ErrNotFound and posts nothing if the deposit wasn't in
+	// from. It returns the journal transaction id
+	Credit(ctx context.Context, id, from, to, reason string, p Posting) (string, error)
+	// ListByUser returns the player's deposits, newest first
+	ListByUser(ctx context.Context, obfID string) ([]Deposit, error)
+	// ListPending returns the pending deposits made by method, oldest first
+	ListPending(ctx context.Context, method string) ([]Deposit, error)
+}
+
+// DepositAddress is the Solana address a player's deposits are sent to
+type DepositAddress struct {
+	ObfID     string
+	Address   string
+	Cursor    string // the newest transaction to the address that's been looked at
+	CreatedAt time.Time
+}
+
+// DepositAddressRepo stores the deposit addresses that have been handed out
+type DepositAddressRepo interface {
+	// Issue stores the player's address if they don't have one yet, and
+	// returns the one they have. It returns ErrDuplicate if the player has
+	// none and address already belongs to someone else
+	Issue(ctx context.Context, obfID, address string) (DepositAddress, error)
+	// List returns the addresses of every account that is still open,
+	// closed accounts' addresses aren't watched any more
+	List(ctx context.Context) ([]DepositAddress, error)
+	SetCursor(ctx context.Context, obfID, signature string) error
+}
+
+// Repos is every repository the server needs, built once at startup
+type Repos struct {
+	Users     UserRepo
+	Balances  BalanceRepo
+	Games     GameRepo
+	Sessions  SessionRepo
+	Audit     AuditRepo
+	Events    EventRepo
+	Deposits  DepositRepo
+	Addresses DepositAddressRepo
+}
@@ -0,0 +1,307 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/audit"
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/repo"
+	"github.com/Scrimzay/loglogger"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+)
+
+var (
+	log *logger.Logger
+)
+
+func init() {
+	var err error
+	log, err = logger.New("sessionlog.txt")
+	if err != nil {
+		log.Fatalf("Failed to start new logger in session: %v", err)
+	}
+}
+
+// cookieName is the session cookie every handler reads. All it carries is
+// the session token, who the player is lives server side in the SessionRepo
+const cookieName = "session-name"
+
+// contextKey is where Load leaves the signed in user in the gin.Context
+const contextKey = "user"
+
+// touchEvery is how stale LastSeen can get before a request writes it again,
+// so browsing doesn't cost a DB write per request
+const touchEvery = time.Minute
+
+// User is the signed in player, as stored in their session
+type User struct {
+	UserID    string // the provider's id for them
+	ObfID     string // the id everything else in the app knows them by
+	SessionID string // which of their sessions this request came in on
+}
+
+// Manager is the one session store the whole server shares. Build it once at
+// startup, the handlers only ever see it through the middleware and the
+// methods below
+type Manager struct {
+	store    *sessions.CookieStore
+	sessions repo.SessionRepo
+	cfg      config.Sessions
+	csrfKey  []byte
+	trail    *audit.Trail
+}
+
+// New builds the session store from the config, keeping the sessions
+// themselves in the given repository. Sign ins and sign outs go to the
+// audit trail
+func New(cfg *config.Config, sessionRepo repo.SessionRepo, trail *audit.Trail) *Manager {
+	store := sessions.NewCookieStore([]byte(cfg.SessionSecret))
+	store.MaxAge(int(cfg.Sessions.AbsoluteTimeout / time.Second))
+	store.Options.Path = "/"
+	store.Options.HttpOnly = true
+	store.Options.Secure = cfg.IsProd()
+	store.Options.SameSite = http.SameSiteLaxMode
+	// a key of its own for CSRF tokens, so they say nothing about the cookie key
+	csrfKey := sha256.Sum256([]byte("csrf:" + cfg.SessionSecret))
+	return &Manager{store: store, sessions: sessionRepo, cfg: cfg.Sessions, csrfKey: csrfKey[:], trail: trail}
+}
+
+// Store is the underlying gorilla store, for gothic to keep its OAuth state in
+func (m *Manager) Store() sessions.Store {
+	return m.store
+}
+
+// Login starts a new server side session for the player and hands the
+// browser its token. Any session the browser already had is ended first, so
+// a token planted before sign in is useless after it
+func (m *Manager) Login(c *gin.Context, u User) error {
+	ctx := c.Request.Context()
+	cookie, err := m.store.Get(c.Request, cookieName)
+	if err != nil {
+		// a cookie we can't decode, start a fresh session over it
+		log.Printf("Replacing unreadable session: %v", err)
+	}
+	if old, ok := cookie.Values["token"].(string); ok {
+		if err := m.sessions.Delete(ctx, hashToken(old)); err != nil {
+			return err
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = m.sessions.Create(ctx, repo.Session{
+		ID:        hashToken(token),
+		UserID:    u.UserID,
+		ObfID:     u.ObfID,
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+		CreatedAt: now,
+		LastSeen:  now,
+	})
+	if err != nil {
+		return err
+	}
+
+	m.trail.RecordOrLog(ctx, audit.TypeLogin, u.ObfID, u.ObfID, audit.Data{
+		"ip":        c.ClientIP(),
+		"userAgent": c.Request.UserAgent(),
+	})
+
+	// cookies from before sessions moved server side carried the ids directly
+	delete(cookie.Values, "user_id")
+	delete(cookie.Values, "obfuscated_id")
+	cookie.Values["token"] = token
+	return cookie.Save(c.Request, c.Writer)
+}
+
+// Logout ends the session this request came in on
+func (m *Manager) Logout(c *gin.Context) error {
+	cookie, err := m.store.Get(c.Request, cookieName)
+	if err != nil {
+		// nothing we can read, so nothing to end
+		return nil
+	}
+	if token, ok := cookie.Values["token"].(string); ok {
+		if err := m.sessions.Delete(c.Request.Context(), hashToken(token)); err != nil {
+			return err
+		}
+		if u, ok := CurrentUser(c); ok {
+			m.trail.RecordOrLog(c.Request.Context(), audit.TypeLogout, u.ObfID, u.ObfID, nil)
+		}
+	}
+	delete(cookie.Values, "token")
+	return cookie.Save(c.Request, c.Writer)
+}
+
+// LogoutEverywhere ends every session the signed in player has, on every
+// device, and returns how many there were
+func (m *Manager) LogoutEverywhere(c *gin.Context) (int, error) {
+	u, ok := CurrentUser(c)
+	if !ok {
+		return 0, nil
+	}
+	ended, err := m.sessions.DeleteByUser(c.Request.Context(), u.UserID)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Logged out everywhere: obfID=%s, sessions=%d", u.ObfID, ended)
+	m.trail.RecordOrLog(c.Request.Context(), audit.TypeLogoutAll, u.ObfID, u.ObfID, audit.Data{"sessions": ended})
+	return ended, m.Logout(c)
+}
+
+// List returns the player's live sessions, most recently used first
+func (m *Manager) List(ctx context.Context, userID string) ([]repo.Session, error) {
+	all, err := m.sessions.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	live := make([]repo.Session, 0, len(all))
+	for _, s := range all {
+		if !m.expired(s, now) {
+			live = append(live, s)
+		}
+	}
+	return live, nil
+}
+
+// Revoke ends one of the player's sessions. It returns repo.ErrNotFound if
+// the session doesn't exist or belongs to someone else
+func (m *Manager) Revoke(ctx context.Context, userID, sessionID string) error {
+	s, err := m.sessions.Find(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if s.UserID != userID {
+		return repo.ErrNotFound
+	}
+	if err := m.sessions.Delete(ctx, sessionID); err != nil {
+		return err
+	}
+	m.trail.RecordOrLog(ctx, audit.TypeSessionRevoke, s.ObfID, s.ObfID, audit.Data{
+		"ip":        s.IP,
+		"userAgent": s.UserAgent,
+	})
+	return nil
+}
+
+// StartSweeper deletes expired sessions in the background. Load already
+// refuses them, this just keeps the table from growing forever
+func (m *Manager) StartSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			deleted, err := m.sessions.DeleteExpired(context.Background(),
+				now.Add(-m.cfg.IdleTimeout), now.Add(-m.cfg.AbsoluteTimeout))
+			if err != nil {
+				log.Printf("Error sweeping sessions: %v", err)
+				continue
+			}
+			if deleted > 0 {
+				log.Printf("Swept %d expired sessions", deleted)
+			}
+		}
+	}()
+}
+
+// Load is middleware that reads the session on every request and puts the
+// signed in player, if there is one, into the gin.Context for CurrentUser
+func (m *Manager) Load() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		cookie, err := m.store.Get(c.Request, cookieName)
+		if err != nil {
+			// bad or stale cookie, treat them as signed out
+			log.Printf("Error reading session: %v", err)
+			c.Next()
+			return
+		}
+		token, _ := cookie.Values["token"].(string)
+		if token == "" {
+			c.Next()
+			return
+		}
+
+		s, err := m.sessions.Find(ctx, hashToken(token))
+		if err != nil {
+			// revoked, swept, or the DB is down. Either way they aren't signed in
+			if !errors.Is(err, repo.ErrNotFound) {
+				log.Printf("Error finding session: %v", err)
+			}
+			c.Next()
+			return
+		}
+
+		now := time.Now()
+		if m.expired(s, now) {
+			if err := m.sessions.Delete(ctx, s.ID); err != nil {
+				log.Printf("Error deleting expired session: %v", err)
+			}
+			c.Next()
+			return
+		}
+		if now.Sub(s.LastSeen) > touchEvery {
+			if err := m.sessions.Touch(ctx, s.ID, now); err != nil {
+				log.Printf("Error touching session: %v", err)
+			}
+		}
+
+		c.Set(contextKey, User{UserID: s.UserID, ObfID: s.ObfID, SessionID: s.ID})
+		c.Set(csrfContextKey, m.csrfToken(s.ID))
+		c.Next()
+	}
+}
+
+func (m *Manager) expired(s repo.Session, now time.Time) bool {
+	return now.Sub(s.LastSeen) > m.cfg.IdleTimeout || now.Sub(s.CreatedAt) > m.cfg.AbsoluteTimeout
+}
+
+// newToken is the secret the browser holds, only its hash is ever stored
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating session token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Required is middleware that sends anyone who isn't signed in to the login
+// page. It has to run after Load
+func Required() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := CurrentUser(c); !ok {
+			c.Redirect(http.StatusFound, "/login")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentUser returns the player Load found in the session
+func CurrentUser(c *gin.Context) (User, bool) {
+	v, ok := c.Get(contextKey)
+	if !ok {
+		return User{}, false
+	}
+	u, ok := v.(User)
+	return u, ok
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/hand"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/money"
+)
+
+// settleHand pays out a finished hand through the ledger. A win gets the
+// stake back and even money, a blackjack the stake and 3:2, a push the stake
+// back, and a loss nothing, the bet was debited when it was placed. The
+// player's moves, the reaper and staff settling a table all come through here.
+// It returns what happened, for the hand history and the staff console
+func settleHand(ctx context.Context, books *ledger.Ledger, gameID string, gs hand.GameState) (string, error) {
+	bet := currency.Format(gs.BetCurrency, gs.BetAmount) + " " + gs.BetCurrency
+
+	var kind ledger.Kind
+	var amount money.Amount
+	var detail string
+	switch gs.Outcome() {
+	case hand.OutcomeBlackjack:
+		// 3:2 in the minor unit, an odd half rounds down
+		kind, amount = ledger.KindPayout, gs.BetAmount+gs.BetAmount*3/2
+		detail = "blackjack, paid "
+	case hand.OutcomeWin:
+		kind, amount = ledger.KindPayout, gs.BetAmount*2
+		detail = "player won, paid "
+	case hand.OutcomePush:
+		kind, amount = ledger.KindRefund, gs.BetAmount
+		detail = "push, refunded "
+	default:
+		detail = "player lost " + bet
+	}
+	if amount > 0 {
+		if _, err := books.Record(ctx, kind, gs.Owner, gs.BetCurrency, amount, gameID); err != nil {
+			return "", fmt.Errorf("error paying out hand: %w", err)
+		}
+		detail += currency.Format(gs.BetCurrency, amount) + " " + gs.BetCurrency
+	}
+	detail += fmt.Sprintf(", player %d v dealer %d", gs.Player.Score(), gs.Dealer.Score())
+
+	log.Printf("Settled game %s: obfID=%s, %s", gameID, gs.Owner, detail)
+	return detail, nil
+}
@@ -0,0 +1,71 @@
+package solana
+
+import (
+	"errors"
+	"math/big"
+)
+
+// the bitcoin alphabet, which is what Solana addresses and signatures use
+const alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var errBase58 = errors.New("invalid base58")
+
+// encode turns b into base58, each leading zero byte becomes a '1'
+func encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for i := 0; i < len(s); i++ {
+		digit := -1
+		for j := 0; j < len(alphabet); j++ {
+			if alphabet[j] == s[i] {
+				digit = j
+				break
+			}
+		}
+		if digit < 0 {
+			return nil, errBase58
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+
+	var zeros int
+	for zeros < len(s) && s[zeros] == alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// ValidAddress reports whether s is a Solana address, a base58 public key
+func ValidAddress(s string) bool {
+	b, err := decode(s)
+	return err == nil && len(b) == 32
+}
+
+// ValidSignature reports whether s is a base58 transaction signature
+func ValidSignature(s string) bool {
+	b, err := decode(s)
+	return err == nil && len(b) == 64
+}
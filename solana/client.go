@@ -0,0 +1,257 @@
+package solana
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Scrimzay/loglogger"
+)
+
+var (
+	log *logger.Logger
+)
+
+func init() {
+	var err error
+	log, err = logger.New("solanalog.txt")
+	if err != nil {
+		log.Fatalf("Error starting new log in solana: %v", err)
+	}
+}
+
+// ErrNotFound is returned for a transaction the node doesn't know about, it
+// may not have landed yet or it may never have existed
+var ErrNotFound = errors.New("transaction not found")
+
+// Client talks to a Solana JSON-RPC endpoint. It only asks for confirmed
+// data, so anything it returns has been voted on by the cluster
+type Client struct {
+	url    string
+	client *http.Client
+	nextID atomic.Int64
+}
+
+func NewClient(url string) *Client {
+	return &Client{url: url, client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      int64             `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      int64           `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// RPCError is an error the node sent back
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("solana rpc error %d: %s", e.Code, e.Message)
+}
+
+func (c *Client) call(ctx context.Context, method string, out any, params ...any) error {
+	req := rpcRequest{JSONRPC: "2.0", ID: c.nextID.Add(1), Method: method}
+	for _, p := range params {
+		raw, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		req.Params = append(req.Params, raw)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("error calling %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error calling %s: node returned %s", method, resp.Status)
+	}
+
+	var rpcResp rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return fmt.Errorf("error decoding %s: %w", method, err)
+	}
+	if rpcResp.Error != nil {
+		return rpcResp.Error
+	}
+	return json.Unmarshal(rpcResp.Result, out)
+}
+
+// commitment is the config object most methods take last
+type commitment struct {
+	Commitment                     string `json:"commitment"`
+	Encoding                       string `json:"encoding,omitempty"`
+	MaxSupportedTransactionVersion *int   `json:"maxSupportedTransactionVersion,omitempty"`
+}
+
+// Slot returns the latest confirmed slot, how deep a transaction is buried
+// is this minus its slot
+func (c *Client) Slot(ctx context.Context) (uint64, error) {
+	var slot uint64
+	err := c.call(ctx, "getSlot", &slot, commitment{Commitment: "confirmed"})
+	return slot, err
+}
+
+// SignatureInfo is one transaction an address took part in
+type SignatureInfo struct {
+	Signature string          `json:"signature"`
+	Slot      uint64          `json:"slot"`
+	Err       json.RawMessage `json:"err"`
+}
+
+// Failed reports whether the transaction landed without running
+func (s SignatureInfo) Failed() bool {
+	return len(s.Err) > 0 && string(s.Err) != "null"
+}
+
+// signaturesConfig is getSignaturesForAddress's config object
+type signaturesConfig struct {
+	Commitment string `json:"commitment"`
+	Limit      int    `json:"limit"`
+	Before     string `json:"before,omitempty"`
+	Until      string `json:"until,omitempty"`
+}
+
+// signaturesLimit is the most getSignaturesForAddress returns at once
+const signaturesLimit = 1000
+
+// Signatures returns the confirmed transactions address took part in since
+// the one with signature until, or all of them if until is empty, newest
+// first
+func (c *Client) Signatures(ctx context.Context, address, until string) ([]SignatureInfo, error) {
+	var all []SignatureInfo
+	// the node pages newest first, so keep asking for the ones before the
+	// oldest we've got until a page comes back short
+	before := ""
+	for {
+		var page []SignatureInfo
+		err := c.call(ctx, "getSignaturesForAddress", &page, address, signaturesConfig{
+			Commitment: "confirmed",
+			Limit:      signaturesLimit,
+			Before:     before,
+			Until:      until,
+		})
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < signaturesLimit {
+			return all, nil
+		}
+		before = page[len(page)-1].Signature
+	}
+}
+
+// Transaction is a confirmed transaction, cut down to what a deposit needs
+type Transaction struct {
+	Signature string
+	Slot      uint64
+	Failed    bool     // it landed but didn't run, nothing moved apart from the fee
+	Signers   []string // the accounts that signed it
+	changes   map[string]int64
+}
+
+// Received is how many lamports address gained from the transaction, what
+// it was actually paid after any fees rather than what an instruction says
+func (t *Transaction) Received(address string) int64 {
+	return t.changes[address]
+}
+
+// SignedBy reports whether address signed the transaction
+func (t *Transaction) SignedBy(address string) bool {
+	for _, s := range t.Signers {
+		if s == address {
+			return true
+		}
+	}
+	return false
+}
+
+// the parts of a jsonParsed getTransaction result we read
+type txResult struct {
+	Slot uint64  `json:"slot"`
+	Meta *txMeta `json:"meta"`
+	Tx   struct {
+		Signatures []string `json:"signatures"`
+		Message    struct {
+			AccountKeys []accountKey `json:"accountKeys"`
+		} `json:"message"`
+	} `json:"transaction"`
+}
+
+type txMeta struct {
+	Err          json.RawMessage `json:"err"`
+	Fee          int64           `json:"fee"`
+	PreBalances  []int64         `json:"preBalances"`
+	PostBalances []int64         `json:"postBalances"`
+}
+
+type accountKey struct {
+	Pubkey   string `json:"pubkey"`
+	Signer   bool   `json:"signer"`
+	Writable bool   `json:"writable"`
+}
+
+// Transaction looks a confirmed transaction up by its signature
+func (c *Client) Transaction(ctx context.Context, signature string) (*Transaction, error) {
+	version := 0
+	var result *txResult
+	err := c.call(ctx, "getTransaction", &result, signature, commitment{
+		Commitment:                     "confirmed",
+		Encoding:                       "jsonParsed",
+		MaxSupportedTransactionVersion: &version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, ErrNotFound
+	}
+	if result.Meta == nil {
+		return nil, errors.New("transaction has no status")
+	}
+
+	keys := result.Tx.Message.AccountKeys
+	if len(result.Meta.PreBalances) != len(keys) || len(result.Meta.PostBalances) != len(keys) {
+		return nil, errors.New("transaction balances don't match its accounts")
+	}
+	tx := &Transaction{
+		Signature: signature,
+		Slot:      result.Slot,
+		Failed:    len(result.Meta.Err) > 0 && string(result.Meta.Err) != "null",
+		changes:   make(map[string]int64),
+	}
+	for i, k := range keys {
+		if k.Signer {
+			tx.Signers = append(tx.Signers, k.Pubkey)
+		}
+		tx.changes[k.Pubkey] += result.Meta.PostBalances[i] - result.Meta.PreBalances[i]
+	}
+	return tx, nil
+}
@@ -0,0 +1,21 @@
+package solana
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// DeriveKey derives the keypair for label from the master key. The same
+// master key and label always give the same keypair, so nothing but the
+// master key has to be kept secret or backed up
+func DeriveKey(masterKey []byte, label string) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("solana-deposit-address:" + label))
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+// Address is the Solana address of a public key
+func Address(key ed25519.PublicKey) string {
+	return encode(key)
+}
@@ -0,0 +1,194 @@
+package solana
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// systemProgram is the account every plain SOL transfer goes through
+const systemProgram = "11111111111111111111111111111111"
+
+// stubFee is what every stub transaction costs its sender, like a real
+// single signature transaction
+const stubFee = 5000
+
+// slotTime is about how long a real slot takes, the stub's chain grows at
+// the same rate so confirmation depth behaves like it would for real
+const slotTime = 400 * time.Millisecond
+
+// Stub is a stand-in Solana JSON-RPC node for local development and tests.
+// It answers getSlot, getTransaction and getSignaturesForAddress like a
+// real node would, and has a stubTransfer method of its own, params
+// [from, to, lamports], that moves SOL and returns the new transaction's
+// signature. Senders never run out, the stub funds them as it goes
+type Stub struct {
+	start time.Time
+
+	mu           sync.Mutex
+	balances     map[string]int64
+	transactions map[string]txResult
+	byAddress    map[string][]SignatureInfo // oldest first
+}
+
+func NewStub() *Stub {
+	return &Stub{
+		start:        time.Now(),
+		balances:     make(map[string]int64),
+		transactions: make(map[string]txResult),
+		byAddress:    make(map[string][]SignatureInfo),
+	}
+}
+
+// Slot is the stub chain's current slot
+func (s *Stub) Slot() uint64 {
+	return uint64(time.Since(s.start) / slotTime)
+}
+
+// Transfer sends lamports from one address to another in a new transaction
+// and returns its signature
+func (s *Stub) Transfer(from, to string, lamports int64) (string, error) {
+	if !ValidAddress(from) || !ValidAddress(to) {
+		return "", errors.New("invalid address")
+	}
+	if from == to || lamports <= 0 {
+		return "", errors.New("invalid transfer")
+	}
+
+	var sig [64]byte
+	if _, err := rand.Read(sig[:]); err != nil {
+		return "", err
+	}
+	signature := encode(sig[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.balances[from] < lamports+stubFee {
+		s.balances[from] = lamports + stubFee
+	}
+
+	var tx txResult
+	tx.Slot = s.Slot()
+	tx.Tx.Signatures = []string{signature}
+	tx.Tx.Message.AccountKeys = []accountKey{
+		{Pubkey: from, Signer: true, Writable: true},
+		{Pubkey: to, Writable: true},
+		{Pubkey: systemProgram},
+	}
+	tx.Meta = &txMeta{
+		Err:          json.RawMessage("null"),
+		Fee:          stubFee,
+		PreBalances:  []int64{s.balances[from], s.balances[to], 1},
+		PostBalances: []int64{s.balances[from] - lamports - stubFee, s.balances[to] + lamports, 1},
+	}
+	s.balances[from] -= lamports + stubFee
+	s.balances[to] += lamports
+	s.transactions[signature] = tx
+	info := SignatureInfo{Signature: signature, Slot: tx.Slot, Err: json.RawMessage("null")}
+	for _, k := range tx.Tx.Message.AccountKeys {
+		s.byAddress[k.Pubkey] = append(s.byAddress[k.Pubkey], info)
+	}
+
+	log.Printf("Stub transfer: %s -> %s, %d lamports, slot %d, signature %s", from, to, lamports, tx.Slot, signature)
+	return signature, nil
+}
+
+func (s *Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req rpcRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRPC(w, rpcResponse{Error: &RPCError{Code: -32700, Message: "parse error"}})
+		return
+	}
+
+	result, rpcErr := s.handle(req)
+	resp := rpcResponse{ID: req.ID, Error: rpcErr}
+	if rpcErr == nil {
+		resp.Result, _ = json.Marshal(result)
+	}
+	writeRPC(w, resp)
+}
+
+func (s *Stub) handle(req rpcRequest) (any, *RPCError) {
+	invalid := &RPCError{Code: -32602, Message: "invalid params"}
+
+	switch req.Method {
+	case "getSlot":
+		return s.Slot(), nil
+
+	case "getTransaction":
+		var signature string
+		if len(req.Params) < 1 || json.Unmarshal(req.Params[0], &signature) != nil {
+			return nil, invalid
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		tx, ok := s.transactions[signature]
+		if !ok {
+			return nil, nil
+		}
+		return tx, nil
+
+	case "getSignaturesForAddress":
+		var address string
+		var cfg signaturesConfig
+		if len(req.Params) < 1 || json.Unmarshal(req.Params[0], &address) != nil {
+			return nil, invalid
+		}
+		if len(req.Params) > 1 && json.Unmarshal(req.Params[1], &cfg) != nil {
+			return nil, invalid
+		}
+		if cfg.Limit <= 0 || cfg.Limit > signaturesLimit {
+			cfg.Limit = signaturesLimit
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// newest first, starting after before and stopping at until
+		sigs := []SignatureInfo{}
+		started := cfg.Before == ""
+		all := s.byAddress[address]
+		for i := len(all) - 1; i >= 0 && len(sigs) < cfg.Limit; i-- {
+			if all[i].Signature == cfg.Until {
+				break
+			}
+			if started {
+				sigs = append(sigs, all[i])
+			}
+			if all[i].Signature == cfg.Before {
+				started = true
+			}
+		}
+		return sigs, nil
+
+	case "stubTransfer":
+		var from, to string
+		var lamports int64
+		if len(req.Params) < 3 ||
+			json.Unmarshal(req.Params[0], &from) != nil ||
+			json.Unmarshal(req.Params[1], &to) != nil ||
+			json.Unmarshal(req.Params[2], &lamports) != nil {
+			return nil, invalid
+		}
+		signature, err := s.Transfer(from, to, lamports)
+		if err != nil {
+			return nil, &RPCError{Code: -32602, Message: err.Error()}
+		}
+		return signature, nil
+
+	default:
+		return nil, &RPCError{Code: -32601, Message: "method not found"}
+	}
+}
+
+func writeRPC(w http.ResponseWriter, resp rpcResponse) {
+	resp.JSONRPC = "2.0"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
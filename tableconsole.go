@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Scrimzay/blackjackgame/admin"
+	"github.com/Scrimzay/blackjackgame/currency"
+	"github.com/Scrimzay/blackjackgame/hand"
+	"github.com/Scrimzay/blackjackgame/history"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/repo"
+)
+
+// tableConsole is what the admin pages see of the games map. Like the
+// reaper, it only holds a table lock while it changes the game state, the
+// ledger and hand history writes happen after
+type tableConsole struct {
+	books *ledger.Ledger
+	games repo.GameRepo
+}
+
+// Summaries snapshots every live table
+func (tc *tableConsole) Summaries() []admin.TableSummary {
+	gamesMu.RLock()
+	defer gamesMu.RUnlock()
+	summaries := make([]admin.TableSummary, 0, len(games))
+	for id, t := range games {
+		t.mu.Lock()
+		gs := *t.gs
+		summary := admin.TableSummary{
+			ID:         id,
+			Seat:       gs.Owner,
+			State:      gs.State.String(),
+			BetInPlay:  gs.BetInProgress(),
+			Player:     gs.Player.Score(),
+			Dealer:     gs.Dealer.Score(),
+			Paused:     t.paused,
+			Closing:    t.closing,
+			Created:    t.created,
+			LastActive: gs.LastActive,
+		}
+		if t.shoe > 0 {
+			summary.Penetration = (t.shoe - len(gs.Deck)) * 100 / t.shoe
+		}
+		t.mu.Unlock()
+
+		if gs.BetAmount > 0 {
+			summary.Bet = currency.Format(gs.BetCurrency, gs.BetAmount) + " " + gs.BetCurrency
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+func (tc *tableConsole) Pause(gameID string, paused bool) (string, error) {
+	t := lookupTable(gameID, false)
+	if t == nil {
+		return "", admin.ErrNoTable
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = paused
+	return t.gs.Owner, nil
+}
+
+func (tc *tableConsole) Settle(ctx context.Context, gameID string) (string, string, error) {
+	t := lookupTable(gameID, false)
+	if t == nil {
+		return "", "", admin.ErrNoTable
+	}
+
+	t.mu.Lock()
+	if !t.gs.BetInProgress() {
+		t.mu.Unlock()
+		return "", "", admin.ErrNoBet
+	}
+	if t.gs.State == hand.StateBetPlaced {
+		t.mu.Unlock()
+		return t.gs.Owner, "", admin.ErrNotDealt
+	}
+	// the player's turn ends here, the dealer plays out as usual, and the
+	// bet comes off the table so the hand can't be paid twice
+	*t.gs = hand.Stand(*t.gs)
+	gs, _ := takeSettlement(t.gs)
+	t.mu.Unlock()
+
+	detail, err := settleHand(ctx, tc.books, gameID, gs)
+	if err != nil {
+		return gs.Owner, "", fmt.Errorf("error paying settled hand: %w", err)
+	}
+
+	return gs.Owner, detail, tc.record(ctx, gameID, gs, history.ActionSettled)
+}
+
+func (tc *tableConsole) Void(ctx context.Context, gameID string) (string, string, error) {
+	t := lookupTable(gameID, false)
+	if t == nil {
+		return "", "", admin.ErrNoTable
+	}
+
+	t.mu.Lock()
+	if !t.gs.BetInProgress() {
+		t.mu.Unlock()
+		return "", "", admin.ErrNoBet
+	}
+	voided := *t.gs
+	// back to an empty table, the cards already drawn stay out of the shoe
+	t.gs.Player = nil
+	t.gs.Dealer = nil
+	t.gs.BetAmount = 0
+	t.gs.State = hand.StatePlayerTurn
+	t.mu.Unlock()
+
+	_, err := tc.books.Record(ctx, ledger.KindRefund, voided.Owner, voided.BetCurrency, voided.BetAmount, gameID)
+	if err != nil {
+		return voided.Owner, "", fmt.Errorf("error refunding voided bet: %w", err)
+	}
+	detail := "refunded " + currency.Format(voided.BetCurrency, voided.BetAmount) + " " + voided.BetCurrency
+
+	return voided.Owner, detail, tc.record(ctx, gameID, voided, history.ActionVoided)
+}
+
+func (tc *tableConsole) Close(ctx context.Context, gameID string) (string, string, error) {
+	t := lookupTable(gameID, false)
+	if t == nil {
+		return "", "", admin.ErrNoTable
+	}
+
+	t.mu.Lock()
+	gs := *t.gs
+	if gs.BetInProgress() {
+		// let the player finish, withTable takes the table away after.
+		// A paused table would never get there, so play carries on
+		t.closing = true
+		t.paused = false
+		t.mu.Unlock()
+		return gs.Owner, "closing after the hand in play", nil
+	}
+	t.mu.Unlock()
+
+	removeTable(gameID, t)
+	return gs.Owner, "closed", tc.record(ctx, gameID, gs, history.ActionClosed)
+}
+
+func (tc *tableConsole) record(ctx context.Context, gameID string, gs hand.GameState, action string) error {
+	log.Printf("Staff %s game %s", action, gameID)
+	return history.Record(ctx, tc.games, history.Entry{
+		GameID:      gameID,
+		ObfID:       gs.Owner,
+		Action:      action,
+		Player:      gs.Player.String(),
+		Dealer:      gs.Dealer.String(),
+		BetAmount:   gs.BetAmount,
+		BetCurrency: gs.BetCurrency,
+	})
+}
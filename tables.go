@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/hand"
+	"github.com/Scrimzay/blackjackgame/money"
+)
+
+// table is a single game with its own lock, so a slow request on one
+// table never holds up the others
+type table struct {
+	mu      sync.Mutex
+	gs      *hand.GameState
+	closed  bool      // set once the table has been removed from games
+	paused  bool      // staff have stopped play, the table can be looked at but not played
+	closing bool      // staff are closing the table, it goes once the hand in play is over
+	created time.Time
+	shoe    int // cards in a full shoe, for working out penetration
+}
+
+var (
+	errClosed        = errors.New("table is closed")
+	errTablePaused   = errors.New("table is paused")
+	errTableClosing  = errors.New("table is closing")
+	errBetRiding     = errors.New("a bet is already riding on this table")
+	errNotYourTable  = errors.New("this table belongs to another player")
+	errClosedAccount = errors.New("this account has been closed")
+)
+
+var (
+	games   = make(map[string]*table) // store game states
+	gamesMu sync.RWMutex              // protects the games map only, always taken before a table lock
+
+	tableDefaults = config.Tables{Decks: 3} // what new tables start with, set once at startup
+
+	closedPlayers   = make(map[string]bool) // accounts closed since startup, their bets are refused
+	closedPlayersMu sync.Mutex              // taken under a table lock, never the other way round
+)
+
+// configureTables sets the defaults for every table created from now on.
+// Call it before the server starts taking requests
+func configureTables(cfg config.Tables) {
+	tableDefaults = cfg
+}
+
+func newTable() *table {
+	shoe := hand.Shuffle(hand.GameState{}, tableDefaults.Decks).Deck // shuffle a new deck
+	return &table{
+		gs: &hand.GameState{
+			Deck:  shoe,
+			State: hand.StatePlayerTurn,
+		},
+		created: time.Now(),
+		shoe:    len(shoe),
+	}
+}
+
+// lookupTable finds the table for gameID, creating it if create is set.
+// It returns nil if the table doesn't exist and create is false
+func lookupTable(gameID string, create bool) *table {
+	gamesMu.RLock()
+	t, exists := games[gameID]
+	gamesMu.RUnlock()
+	if exists || !create {
+		return t
+	}
+
+	gamesMu.Lock()
+	defer gamesMu.Unlock()
+	// someone may have beaten us to it between the two locks
+	if t, exists = games[gameID]; !exists {
+		t = newTable()
+		games[gameID] = t
+	}
+	return t
+}
+
+// withTable runs fn against the game state while holding only that table's
+// lock and returns a copy of the state to render once the lock is released.
+// The hand package never mutates a state in place, so the copy is safe to
+// read after other requests move the game on. fn doesn't run while the
+// table is paused, the copy is still returned so the table can be shown
+func withTable(gameID string, create bool, fn func(gs *hand.GameState)) (hand.GameState, bool) {
+	for {
+		t := lookupTable(gameID, create)
+		if t == nil {
+			return hand.GameState{}, false
+		}
+
+		snapshot, err := t.run(fn, false)
+		if errors.Is(err, errClosed) {
+			// the table was removed after we looked it up, go again
+			continue
+		}
+		t.retireIfDone(gameID, snapshot)
+		return snapshot, true
+	}
+}
+
+// placeBet puts obfID's bet down on the table, ready for the deal. A
+// paused or closing table refuses it, and so does a table with a bet already
+// riding or that belongs to someone else. The bet is already in the ledger
+// by now, so the caller has to refund it if this returns an error
+func placeBet(gameID, obfID, betCurrency string, betAmount money.Amount) (hand.GameState, error) {
+	for {
+		t := lookupTable(gameID, true)
+		var refused error
+		snapshot, err := t.run(func(gs *hand.GameState) {
+			closedPlayersMu.Lock()
+			closed := closedPlayers[obfID]
+			closedPlayersMu.Unlock()
+			switch {
+			case closed:
+				refused = errClosedAccount
+			case gs.Owner != "" && gs.Owner != obfID:
+				refused = errNotYourTable
+			case gs.BetInProgress():
+				refused = errBetRiding
+			default:
+				// a new hand, the cards from the last one are done with
+				gs.Player = nil
+				gs.Dealer = nil
+				gs.BetAmount = betAmount
+				gs.BetCurrency = betCurrency
+				gs.Owner = obfID
+				gs.State = hand.StateBetPlaced
+			}
+		}, true)
+		if errors.Is(err, errClosed) {
+			continue
+		}
+		if err == nil {
+			err = refused
+		}
+		return snapshot, err
+	}
+}
+
+// takeSettlement is called under the table lock after every move. Once the
+// hand with a bet on it is over it takes the bet off the table, so the hand
+// is only ever paid once, and returns the hand for settleHand to pay once
+// the lock is released
+func takeSettlement(gs *hand.GameState) (hand.GameState, bool) {
+	if gs.State != hand.StateHandOver || gs.BetAmount <= 0 {
+		return hand.GameState{}, false
+	}
+	settled := *gs
+	gs.BetAmount = 0
+	return settled, true
+}
+
+// run applies fn under the table lock. The deferred unlock matters: hand.Hit
+// panics when it isn't anyone's turn and gin recovers, so the lock must not leak
+func (t *table) run(fn func(gs *hand.GameState), bet bool) (hand.GameState, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.closed:
+		return hand.GameState{}, errClosed
+	case t.paused:
+		return *t.gs, errTablePaused
+	case bet && t.closing:
+		return *t.gs, errTableClosing
+	}
+	fn(t.gs)
+	t.gs.LastActive = time.Now() // keep the table alive for the reaper
+	return *t.gs, nil
+}
+
+// retireIfDone removes a closing table once the hand in play is over
+func (t *table) retireIfDone(gameID string, gs hand.GameState) {
+	t.mu.Lock()
+	closing := t.closing
+	t.mu.Unlock()
+	if closing && !gs.BetInProgress() {
+		removeTable(gameID, t)
+	}
+}
+
+// removeTable takes the table out of the games map for good. Anyone still
+// holding it finds it closed and looks again
+func removeTable(gameID string, t *table) {
+	gamesMu.Lock()
+	defer gamesMu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if games[gameID] == t {
+		delete(games, gameID)
+	}
+	t.closed = true
+}
+
+// tableStatus is what the game page tells the player about the table
+func tableStatus(gameID string) string {
+	t := lookupTable(gameID, false)
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.paused:
+		return "This table has been paused by staff, play will resume shortly."
+	case t.closing:
+		return "This table is closing, no new bets. Finish your hand and move to another table."
+	}
+	return ""
+}
+
+// activeBets counts the tables where obfID has a bet riding, for the account
+// closure check
+func activeBets(obfID string) int {
+	gamesMu.RLock()
+	defer gamesMu.RUnlock()
+	count := 0
+	for _, t := range games {
+		t.mu.Lock()
+		if t.gs.Owner == obfID && t.gs.BetInProgress() {
+			count++
+		}
+		t.mu.Unlock()
+	}
+	return count
+}
+
+// holdTables runs fn with every table locked, so no bet goes down anywhere
+// until it returns, and hands it the number of tables where obfID has a bet
+// riding. It's for closing the account: if fn succeeds the account is closed
+// and placeBet refuses obfID from then on, including a bet already debited
+// but not yet on a table, which its caller refunds
+func holdTables(obfID string, fn func(activeBets int) error) error {
+	gamesMu.Lock()
+	defer gamesMu.Unlock()
+	count := 0
+	for _, t := range games {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.gs.Owner == obfID && t.gs.BetInProgress() {
+			count++
+		}
+	}
+
+	if err := fn(count); err != nil {
+		return err
+	}
+	closedPlayersMu.Lock()
+	closedPlayers[obfID] = true
+	closedPlayersMu.Unlock()
+	return nil
+}
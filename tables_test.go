@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Scrimzay/blackjackgame/config"
+	"github.com/Scrimzay/blackjackgame/hand"
+	"github.com/Scrimzay/blackjackgame/history"
+	"github.com/Scrimzay/blackjackgame/ledger"
+	"github.com/Scrimzay/blackjackgame/money"
+	"github.com/Scrimzay/blackjackgame/repo"
+)
+
+// these run against the package level games map, run them with -race
+
+func resetTables(t *testing.T) {
+	t.Helper()
+	empty := func() {
+		gamesMu.Lock()
+		games = make(map[string]*table)
+		gamesMu.Unlock()
+	}
+	empty()
+	t.Cleanup(empty)
+}
+
+// testBooks is a ledger on the in-memory backend, with a stake in chips for
+// every player
+func testBooks(t *testing.T, players ...string) (*ledger.Ledger, *repo.Repos) {
+	t.Helper()
+	repos := repo.NewMemory()
+	books := ledger.New(repos.Balances)
+	for _, p := range players {
+		if _, err := books.Record(context.Background(), ledger.KindAdjustCredit, p, "chips", 1_000_000, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return books, repos
+}
+
+func TestLookupTableConcurrent(t *testing.T) {
+	resetTables(t)
+
+	const n = 50
+	found := make([]*table, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			found[i] = lookupTable("t1", true)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, tb := range found {
+		if tb == nil || tb != found[0] {
+			t.Fatalf("lookup %d got a different table", i)
+		}
+	}
+	if lookupTable("missing", false) != nil {
+		t.Fatal("lookupTable created a table without create")
+	}
+}
+
+func TestPlaceBetConcurrent(t *testing.T) {
+	resetTables(t)
+	players := []string{"alice", "bob", "carol"}
+	books, _ := testBooks(t, players...)
+	ctx := context.Background()
+
+	// everyone piles onto one table, only one bet can be riding on it
+	var placed, riding, taken atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			_, err := takeBet(ctx, books, "t1", p, "chips", 100)
+			switch {
+			case err == nil:
+				placed.Add(1)
+			case errors.Is(err, errBetRiding):
+				riding.Add(1)
+			case errors.Is(err, errNotYourTable):
+				taken.Add(1)
+			default:
+				t.Error(err)
+			}
+		}(players[i%len(players)])
+	}
+	wg.Wait()
+
+	if placed.Load() != 1 {
+		t.Fatalf("%d bets placed on one table, want 1", placed.Load())
+	}
+	if placed.Load()+riding.Load()+taken.Load() != 30 {
+		t.Fatalf("placed %d, riding %d, taken %d, want 30 in all", placed.Load(), riding.Load(), taken.Load())
+	}
+
+	// the refused bets were all handed back
+	gs, _ := withTable("t1", false, func(gs *hand.GameState) {})
+	for _, p := range players {
+		balances, err := books.Balances(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := money.Amount(1_000_000)
+		if p == gs.Owner {
+			want -= 100
+		}
+		if balances["chips"] != want {
+			t.Errorf("%s has %d chips, want %d", p, balances["chips"], want)
+		}
+	}
+}
+
+// TestMoveOnSomeoneElsesBet has a second player try to play out the first
+// one's hand. Only the owner decides how their bet settles
+func TestMoveOnSomeoneElsesBet(t *testing.T) {
+	resetTables(t)
+	books, _ := testBooks(t, "alice", "bob")
+	ctx := context.Background()
+
+	deal := func(gs *hand.GameState) {
+		if gs.State == hand.StateBetPlaced {
+			*gs = hand.Deal(*gs)
+		}
+	}
+	stand := func(gs *hand.GameState) {
+		if gs.State == hand.StatePlayerTurn {
+			*gs = hand.Stand(*gs)
+		}
+	}
+
+	// a blackjack is over as soon as it's dealt, bet again until there's a
+	// hand to stand on
+	for {
+		if _, err := takeBet(ctx, books, "t1", "alice", "chips", 100); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := playMove(ctx, books, "t1", "bob", false, deal); !errors.Is(err, errNotYourTable) {
+			t.Fatalf("bob dealing alice's bet: err = %v, want errNotYourTable", err)
+		}
+		gs, _, err := playMove(ctx, books, "t1", "alice", false, deal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gs.State == hand.StatePlayerTurn {
+			break
+		}
+	}
+
+	if _, _, err := playMove(ctx, books, "t1", "bob", false, stand); !errors.Is(err, errNotYourTable) {
+		t.Fatalf("bob standing on alice's bet: err = %v, want errNotYourTable", err)
+	}
+	gs, _ := withTable("t1", false, func(gs *hand.GameState) {})
+	if gs.State != hand.StatePlayerTurn || gs.BetAmount != 100 {
+		t.Fatalf("alice's hand is %s with %d riding after bob's stand, want her turn with 100", gs.State, gs.BetAmount)
+	}
+
+	if _, _, err := playMove(ctx, books, "t1", "alice", false, stand); err != nil {
+		t.Fatal(err)
+	}
+	if n := activeBets("alice"); n != 0 {
+		t.Fatalf("alice still has %d bets riding after standing", n)
+	}
+}
+
+// TestCloseHoldsTables checks the account closure sees a bet riding, and
+// that a closed account's bets are refused and handed back
+func TestCloseHoldsTables(t *testing.T) {
+	resetTables(t)
+	books, _ := testBooks(t, "alice", "carol")
+	ctx := context.Background()
+	t.Cleanup(func() {
+		closedPlayersMu.Lock()
+		delete(closedPlayers, "carol")
+		closedPlayersMu.Unlock()
+	})
+
+	if _, err := takeBet(ctx, books, "t1", "alice", "chips", 100); err != nil {
+		t.Fatal(err)
+	}
+	errBusy := errors.New("busy")
+	err := holdTables("alice", func(activeBets int) error {
+		if activeBets != 1 {
+			t.Errorf("alice has %d bets riding, want 1", activeBets)
+		}
+		return errBusy
+	})
+	if !errors.Is(err, errBusy) {
+		t.Fatalf("holdTables: err = %v, want fn's error", err)
+	}
+
+	if err := holdTables("carol", func(activeBets int) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := takeBet(ctx, books, "t2", "carol", "chips", 100); !errors.Is(err, errClosedAccount) {
+		t.Fatalf("closed account's bet: err = %v, want errClosedAccount", err)
+	}
+	balances, err := books.Balances(ctx, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balances["chips"] != 1_000_000 {
+		t.Fatalf("carol has %d chips after the refused bet, want it handed back", balances["chips"])
+	}
+}
+
+// TestTablesUnderLoad plays many tables at once while staff and the reaper
+// work on them, then checks every bet that was taken was paid out or handed
+// back exactly once
+func TestTablesUnderLoad(t *testing.T) {
+	resetTables(t)
+	players := []string{"alice", "bob", "carol", "dave"}
+	books, repos := testBooks(t, players...)
+	ctx := context.Background()
+	tc := &tableConsole{books: books, games: repos.Games}
+	rp := &reaper{
+		cfg:   config.Tables{IdleTTL: 2 * time.Millisecond, ExpiryPolicy: config.ExpiryStand},
+		books: books,
+		games: repos.Games,
+	}
+
+	var placed, playedOut atomic.Int64
+	play := func(gameID, p string, move func(gs *hand.GameState)) {
+		gs, _, err := playMove(ctx, books, gameID, p, false, move)
+		if err != nil && !errors.Is(err, errNotYourTable) {
+			t.Error(err)
+		}
+		if gs.State == hand.StateHandOver && gs.BetAmount > 0 {
+			playedOut.Add(1)
+		}
+	}
+
+	stop := make(chan struct{})
+	var staff sync.WaitGroup
+	staff.Add(1)
+	go func() {
+		// staff and the reaper, until the players are done
+		defer staff.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			gameID := fmt.Sprintf("t%d", i%8)
+			switch i % 4 {
+			case 0:
+				tc.Settle(ctx, gameID)
+			case 1:
+				tc.Void(ctx, gameID)
+			case 2:
+				tc.Close(ctx, gameID)
+			case 3:
+				rp.reapIdleGames(time.Now())
+			}
+			tc.Summaries()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i, p := range players {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			for round := 0; round < 100; round++ {
+				gameID := fmt.Sprintf("t%d", (i+round)%8)
+				if _, err := takeBet(ctx, books, gameID, p, "chips", 100); err == nil {
+					placed.Add(1)
+				}
+				// some hands are walked away from before the deal or half way
+				// through, for staff or the reaper to finish
+				if round%5 == 1 {
+					continue
+				}
+				play(gameID, p, func(gs *hand.GameState) {
+					if gs.State == hand.StateBetPlaced {
+						*gs = hand.Deal(*gs)
+					}
+				})
+				if round%5 == 2 {
+					continue
+				}
+				play(gameID, p, func(gs *hand.GameState) {
+					if gs.State == hand.StatePlayerTurn && len(gs.Player) > 0 && gs.Player.Score() < 14 {
+						*gs = hand.Hit(*gs)
+					}
+				})
+				play(gameID, p, func(gs *hand.GameState) {
+					if gs.State == hand.StatePlayerTurn && len(gs.Player) > 0 {
+						*gs = hand.Stand(*gs)
+					}
+				})
+				activeBets(p)
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	close(stop)
+	staff.Wait()
+
+	// expire whatever is left, so no bet is still riding
+	rp.reapIdleGames(time.Now().Add(time.Hour))
+	gamesMu.RLock()
+	left := len(games)
+	gamesMu.RUnlock()
+	if left != 0 {
+		t.Fatalf("%d tables left after reaping everything", left)
+	}
+
+	// every bet placed was finished exactly once, by the player, staff or
+	// the reaper
+	var finished int64
+	for _, p := range players {
+		if n := activeBets(p); n != 0 {
+			t.Errorf("%s still has %d bets riding", p, n)
+		}
+		entries, err := repos.Games.History(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			switch e.Action {
+			case history.ActionSettled, history.ActionVoided, history.ActionExpiredStand, history.ActionExpiredRefund:
+				finished++
+			}
+		}
+	}
+	if placed.Load() == 0 {
+		t.Fatal("no bets were placed")
+	}
+	if got := playedOut.Load() + finished; got != placed.Load() {
+		t.Fatalf("%d bets placed but %d finished (%d played out, %d by staff or the reaper)",
+			placed.Load(), got, playedOut.Load(), finished)
+	}
+
+	report, err := books.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("ledger doesn't reconcile: %+v", report)
+	}
+}